@@ -0,0 +1,267 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"jupyterhub-ssh-proxy/integrity"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+	"golang.org/x/crypto/ssh"
+)
+
+const MODULENAME = "audit"
+
+type AuditConfig struct {
+	// Path of the JSON lines file, "-" writes to stdout and an empty path
+	// turns the file off.
+	Path string `mapstructure:"path"`
+	// Sign hash-chains the file and keeps a manifest signed with the
+	// signing key of the proxy next to it, updated every
+	// CheckpointInterval and when the proxy stops.
+	Sign               bool          `mapstructure:"sign"`
+	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval"`
+	Syslog             SyslogConfig  `mapstructure:"syslog"`
+	// Webhooks are notified of logins, bursts of failed logins, session
+	// ends and policy denials.
+	Webhooks []WebhookConfig `mapstructure:"webhooks"`
+}
+
+// Sink receives every audit event.
+type Sink interface {
+	Emit(e Event)
+}
+
+// Auditor fans audit events out to its sinks.
+type Auditor struct {
+	mu     sync.RWMutex
+	sinks  []Sink
+	logger log.Logger
+}
+
+// NewAuditor creates an auditor, signer signs the file when c.Sign is set.
+func NewAuditor(c AuditConfig, signer ssh.Signer, logger log.Logger) (*Auditor, error) {
+	a := &Auditor{logger: logger}
+
+	if c.Path != "" && c.Sign {
+		if signer == nil {
+			return nil, fmt.Errorf("audit log signing needs a signing key")
+		}
+		interval := c.CheckpointInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		sink, err := NewSignedFileSink(c.Path, signer, interval, logger)
+		if err != nil {
+			return nil, err
+		}
+		a.AddSink(sink)
+	} else if c.Path != "" {
+		sink, err := NewFileSink(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		a.AddSink(sink)
+	}
+
+	if c.Syslog.Enabled {
+		sink, err := NewSyslogSink(c.Syslog, logger)
+		if err != nil {
+			return nil, err
+		}
+		a.AddSink(sink)
+	}
+
+	for _, webhook := range c.Webhooks {
+		sink, err := NewWebhookSink(webhook, logger)
+		if err != nil {
+			return nil, err
+		}
+		a.AddSink(sink)
+	}
+
+	return a, nil
+}
+
+func (a *Auditor) AddSink(sink Sink) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sinks = append(a.sinks, sink)
+}
+
+func (a *Auditor) Emit(e Event) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, sink := range a.sinks {
+		sink.Emit(e)
+	}
+}
+
+// Close closes the sinks that need it.
+func (a *Auditor) Close() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var err error
+	for _, sink := range a.sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// FileSink writes events as JSON lines.
+type FileSink struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// Set for a signed file.
+	path   string
+	chain  *integrity.Chain
+	signer ssh.Signer
+	signed int64
+	closed bool
+	done   chan struct{}
+	logger log.Logger
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	if path == "-" {
+		return &FileSink{w: os.Stdout}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %s", err)
+	}
+
+	return &FileSink{w: f}, nil
+}
+
+func (s *FileSink) Emit(e Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	line := append(b, '\n')
+	n, _ := s.w.Write(line)
+	if s.chain != nil {
+		s.chain.Write(line[:n])
+	}
+}
+
+// NewSignedFileSink opens a file sink that hash-chains its lines and signs
+// a checkpoint of the chain every interval. Lines already in the file are
+// checked against their manifest and chained on, a file that does not
+// match its manifest is left alone and the sink is not opened.
+func NewSignedFileSink(path string, signer ssh.Signer, interval time.Duration, logger log.Logger) (*FileSink, error) {
+	if path == "-" {
+		return nil, fmt.Errorf("the audit log on stdout cannot be signed")
+	}
+
+	s := &FileSink{path: path,
+		chain:  integrity.NewChain(),
+		signer: signer,
+		done:   make(chan struct{}),
+		logger: logger}
+
+	if f, err := os.Open(path); err == nil {
+		if _, err := os.Stat(path + integrity.ManifestSuffix); err == nil {
+			if _, err := integrity.VerifyFile(path, signer.PublicKey()); err != nil {
+				f.Close()
+				// Signing on would cover up the change.
+				return nil, fmt.Errorf("audit log %s does not match its manifest, move both aside to start a new log: %s", path, err)
+			}
+		}
+		_, err = io.Copy(s.chain, bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read audit log: %s", err)
+		}
+	}
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		return nil, err
+	}
+	s.w = sink.w
+
+	if err := s.checkpoint(false); err != nil {
+		return nil, err
+	}
+	go s.checkpointLoop(interval)
+	return s, nil
+}
+
+// checkpoint signs the lines written so far, the file is complete once it
+// is closed.
+func (s *FileSink) checkpoint(complete bool) error {
+	m := integrity.NewManifest(s.path, s.chain, complete)
+	if err := m.Sign(s.signer); err != nil {
+		return fmt.Errorf("sign audit log: %s", err)
+	}
+	if err := integrity.WriteManifestFile(s.path+integrity.ManifestSuffix, m); err != nil {
+		return fmt.Errorf("write audit log manifest: %s", err)
+	}
+	s.signed = m.Lines
+	return nil
+}
+
+func (s *FileSink) checkpointLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if lines, _, _ := s.chain.State(); !s.closed && lines != s.signed {
+			if err := s.checkpoint(false); err != nil {
+				s.logger.Error(MODULENAME, err.Error())
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close signs the final state of a signed file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chain == nil || s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+
+	s.chain.Close()
+	err := s.checkpoint(true)
+	if cerr := s.w.(io.Closer).Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package audit
+
+import "time"
+
+const (
+	EventConnect      = "connect"
+	EventAuthAttempt  = "auth_attempt"
+	EventAuthResult   = "auth_result"
+	EventUpstream     = "upstream"
+	EventChannelOpen  = "channel_open"
+	EventChannelClose = "channel_close"
+	EventExec         = "exec"
+	EventSubsystem    = "subsystem"
+	EventForward      = "forward"
+	EventExit         = "exit"
+	EventInput        = "input"
+	EventSessionEnd   = "session_end"
+	EventShadowAttach = "shadow_attach"
+	EventShadowDetach = "shadow_detach"
+	EventPolicy       = "policy"
+	EventTrafficDaily = "traffic_daily"
+	EventTrafficAlert = "traffic_alert"
+	EventLockout      = "lockout"
+	EventSessionKill  = "session_kill"
+	EventUserBlock    = "user_block"
+	EventUserUnblock  = "user_unblock"
+)
+
+// Event is one line of the audit stream. Every event carries the session
+// ID of the connection it belongs to. Events without a connection carry an
+// ID of their own: traffic_daily "traffic-<day>", shared by the events of
+// a day, user_block and user_unblock "admin-<id>" of the admin request.
+// traffic_alert carries the session that went over the limit. The other
+// fields are set depending on the event type.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	SessionID  string    `json:"session_id"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+
+	// auth_attempt, auth_result
+	Method      string `json:"method,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Success     *bool  `json:"success,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+
+	// upstream, channel_open, forward
+	Server string `json:"server,omitempty"`
+	Pod    string `json:"pod,omitempty"`
+	PodIP  string `json:"pod_ip,omitempty"`
+
+	// channel_open, channel_close, exec, subsystem, forward, exit, input,
+	// policy
+	ChannelID   int    `json:"channel_id,omitempty"`
+	ChannelType string `json:"channel_type,omitempty"`
+	Command     string `json:"command,omitempty"`
+	Subsystem   string `json:"subsystem,omitempty"`
+	Target      string `json:"target,omitempty"`
+	ExitStatus  *int   `json:"exit_status,omitempty"`
+	ExitSignal  string `json:"exit_signal,omitempty"`
+	Request     string `json:"request,omitempty"`
+	Input       string `json:"input,omitempty"`
+	Redacted    bool   `json:"redacted,omitempty"`
+
+	// shadow_attach, shadow_detach: Target is the watched session
+	WatchedUser string `json:"watched_user,omitempty"`
+
+	// channel_close, session_end, traffic_daily, traffic_alert
+	BytesIn  int64   `json:"bytes_in,omitempty"`
+	BytesOut int64   `json:"bytes_out,omitempty"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+	Day      string  `json:"day,omitempty"`
+}
+
+func Bool(b bool) *bool {
+	return &b
+}
+
+func Int(i int) *int {
+	return &i
+}
@@ -0,0 +1,345 @@
+package audit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+)
+
+// syslogEnterprise is the private enterprise number of the structured data
+// element, the documentation number of RFC 5612.
+const syslogEnterprise = "32473"
+
+const syslogQueue = 1024
+
+var syslogFacilities = map[string]int{"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23}
+
+// ValidSyslogFacility reports whether name is a syslog facility.
+func ValidSyslogFacility(name string) bool {
+	_, ok := syslogFacilities[name]
+	return ok
+}
+
+// defaultSyslogEvents are the security relevant events, policy events are
+// only sent for denials.
+var defaultSyslogEvents = []string{EventAuthResult, EventLockout, EventPolicy, EventUpstream, EventSessionEnd,
+	EventShadowAttach, EventShadowDetach, EventTrafficAlert, EventSessionKill,
+	EventUserBlock, EventUserUnblock}
+
+type SyslogConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Network is "udp", "tcp" or "tls".
+	Network  string `mapstructure:"network"`
+	Address  string `mapstructure:"address"`
+	Facility string `mapstructure:"facility"`
+	AppName  string `mapstructure:"app_name"`
+	// CEF sends the events in ArcSight Common Event Format instead of JSON.
+	CEF bool `mapstructure:"cef"`
+	// Events are the event types sent, the security events by default.
+	Events []string `mapstructure:"events"`
+	// CAFile verifies the server certificate for tls, the system roots are
+	// used when it is empty.
+	CAFile             string `mapstructure:"ca_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// SyslogSink sends audit events to a syslog server as RFC 5424 messages,
+// with octet counting framing over tcp and tls. Events are queued and sent
+// in the background, when the server cannot keep up they are dropped.
+type SyslogSink struct {
+	network  string
+	address  string
+	tls      *tls.Config
+	facility int
+	hostname string
+	appName  string
+	procID   string
+	cef      bool
+	events   map[string]bool
+	queue    chan Event
+	logger   log.Logger
+}
+
+func NewSyslogSink(c SyslogConfig, logger log.Logger) (*SyslogSink, error) {
+	s := &SyslogSink{network: c.Network,
+		address: c.Address,
+		appName: c.AppName,
+		procID:  strconv.Itoa(os.Getpid()),
+		cef:     c.CEF,
+		events:  make(map[string]bool),
+		queue:   make(chan Event, syslogQueue),
+		logger:  logger}
+
+	switch s.network {
+	case "":
+		s.network = "udp"
+	case "udp", "tcp":
+	case "tls":
+		s.tls = &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+		if c.CAFile != "" {
+			pem, err := ioutil.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("syslog ca file: %s", err)
+			}
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("syslog ca file %s has no certificate", c.CAFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown syslog network %q", c.Network)
+	}
+	if s.address == "" {
+		return nil, fmt.Errorf("syslog address is not set")
+	}
+
+	facility := c.Facility
+	if facility == "" {
+		facility = "auth"
+	}
+	var ok bool
+	if s.facility, ok = syslogFacilities[facility]; !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", c.Facility)
+	}
+
+	if s.appName == "" {
+		s.appName = "jupyterhub-ssh-proxy"
+	}
+	if s.hostname, _ = os.Hostname(); s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	events := c.Events
+	if len(events) == 0 {
+		events = defaultSyslogEvents
+	}
+	for _, event := range events {
+		s.events[event] = true
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *SyslogSink) Emit(e Event) {
+	if !s.events[e.Type] {
+		return
+	}
+	if e.Type == EventPolicy && e.Success != nil && *e.Success {
+		return
+	}
+
+	select {
+	case s.queue <- e:
+	default:
+		s.logger.Warn(MODULENAME, fmt.Sprintf("Syslog queue full, dropped %s event", e.Type))
+	}
+}
+
+func (s *SyslogSink) dial() (net.Conn, error) {
+	if s.tls != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.address, s.tls)
+	}
+	return net.DialTimeout(s.network, s.address, 10*time.Second)
+}
+
+func (s *SyslogSink) run() {
+	var conn net.Conn
+	backoff := time.Second
+
+	for e := range s.queue {
+		msg := s.format(e)
+		if s.network != "udp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+
+		for conn == nil {
+			var err error
+			if conn, err = s.dial(); err != nil {
+				s.logger.Warn(MODULENAME, fmt.Sprintf("Syslog connect to %s get err: %s", s.address, err.Error()))
+				time.Sleep(backoff)
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+			}
+		}
+		backoff = time.Second
+
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			// The event is lost, the next one reconnects.
+			s.logger.Warn(MODULENAME, fmt.Sprintf("Syslog write get err: %s", err.Error()))
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// severity of an event, as syslog severity and CEF severity.
+func severity(e Event) (int, int) {
+	failed := e.Success != nil && !*e.Success
+	switch {
+	case e.Type == EventLockout:
+		return 4, 8
+	case e.Type == EventTrafficAlert:
+		return 4, 6
+	case e.Type == EventPolicy && failed:
+		return 4, 6
+	case failed:
+		return 4, 5
+	case e.Type == EventAuthResult, e.Type == EventShadowAttach:
+		return 5, 3
+	default:
+		return 6, 1
+	}
+}
+
+// format builds an RFC 5424 message.
+func (s *SyslogSink) format(e Event) string {
+	sev, _ := severity(e)
+	header := fmt.Sprintf("<%d>1 %s %s %s %s %s", s.facility*8+sev,
+		e.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.appName, s.procID, e.Type)
+
+	var sd strings.Builder
+	sd.WriteString("[ssh@" + syslogEnterprise)
+	for _, field := range eventFields(e) {
+		fmt.Fprintf(&sd, " %s=\"%s\"", field[0], sdEscape(field[1]))
+	}
+	sd.WriteString("]")
+
+	var msg string
+	if s.cef {
+		msg = s.formatCEF(e)
+	} else {
+		b, _ := json.Marshal(e)
+		msg = string(b)
+	}
+
+	return header + " " + sd.String() + " \xef\xbb\xbf" + msg
+}
+
+// formatCEF builds a CEF:0 message of an event.
+func (s *SyslogSink) formatCEF(e Event) string {
+	_, sev := severity(e)
+	name := e.Type
+	if e.Success != nil {
+		if *e.Success {
+			name += " succeeded"
+		} else {
+			name += " failed"
+		}
+	}
+
+	ext := []string{"rt=" + strconv.FormatInt(e.Time.UnixNano()/int64(time.Millisecond), 10)}
+	for _, field := range eventFields(e) {
+		key, ok := cefKeys[field[0]]
+		if !ok {
+			continue
+		}
+		if label, ok := cefLabels[key]; ok {
+			ext = append(ext, key+"Label="+label)
+		}
+		ext = append(ext, key+"="+cefEscape(field[1]))
+	}
+
+	return fmt.Sprintf("CEF:0|JupyterHub|%s|1.0|%s|%s|%d|%s", cefHeaderEscape(s.appName),
+		cefHeaderEscape(e.Type), cefHeaderEscape(name), sev, strings.Join(ext, " "))
+}
+
+// cefKeys maps event fields to CEF extension keys, fields without a key
+// are left out.
+var cefKeys = map[string]string{"session_id": "cs1",
+	"user":        "suser",
+	"remote_addr": "src",
+	"method":      "cs2",
+	"fingerprint": "cs3",
+	"reason":      "reason",
+	"pod":         "dhost",
+	"pod_ip":      "dst",
+	"command":     "cmd",
+	"target":      "request",
+	"bytes_in":    "in",
+	"bytes_out":   "out",
+	"outcome":     "outcome"}
+
+var cefLabels = map[string]string{"cs1": "sessionId",
+	"cs2": "authMethod",
+	"cs3": "keyFingerprint"}
+
+// eventFields lists the fields of an event that are set, by JSON name.
+func eventFields(e Event) [][2]string {
+	fields := [][2]string{{"session_id", e.SessionID}}
+	add := func(name string, value string) {
+		if value != "" {
+			fields = append(fields, [2]string{name, value})
+		}
+	}
+
+	add("user", e.User)
+	if host, _, err := net.SplitHostPort(e.RemoteAddr); err == nil {
+		add("remote_addr", host)
+	} else {
+		add("remote_addr", e.RemoteAddr)
+	}
+	add("method", e.Method)
+	add("fingerprint", e.Fingerprint)
+	if e.Success != nil {
+		add("outcome", map[bool]string{true: "success", false: "failure"}[*e.Success])
+	}
+	add("reason", e.Reason)
+	add("server", e.Server)
+	add("pod", e.Pod)
+	add("pod_ip", e.PodIP)
+	if e.ChannelID != 0 {
+		add("channel_id", strconv.Itoa(e.ChannelID))
+	}
+	add("channel_type", e.ChannelType)
+	add("command", e.Command)
+	add("subsystem", e.Subsystem)
+	add("target", e.Target)
+	add("request", e.Request)
+	add("watched_user", e.WatchedUser)
+	add("input", e.Input)
+	if e.ExitStatus != nil {
+		add("exit_status", strconv.Itoa(*e.ExitStatus))
+	}
+	add("exit_signal", e.ExitSignal)
+	if e.BytesIn != 0 {
+		add("bytes_in", strconv.FormatInt(e.BytesIn, 10))
+	}
+	if e.BytesOut != 0 {
+		add("bytes_out", strconv.FormatInt(e.BytesOut, 10))
+	}
+	if e.Duration != 0 {
+		add("duration_seconds", strconv.FormatFloat(e.Duration, 'f', 3, 64))
+	}
+	add("day", e.Day)
+
+	return fields
+}
+
+// sdEscape escapes a structured data parameter value, RFC 5424 section 6.3.3.
+func sdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+func cefHeaderEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`).Replace(s)
+}
+
+func cefEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,325 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+)
+
+// Webhook events, derived from the audit stream.
+const (
+	WebhookLoginSuccess      = "login_success"
+	WebhookLoginFailureBurst = "login_failure_burst"
+	WebhookSessionEnd        = "session_end"
+	WebhookPolicyDenied      = "policy_denied"
+)
+
+// WebhookEvents are all webhook events.
+var WebhookEvents = []string{WebhookLoginSuccess, WebhookLoginFailureBurst, WebhookSessionEnd, WebhookPolicyDenied}
+
+// webhookCloseTimeout bounds the time Close spends on queued deliveries.
+const webhookCloseTimeout = 10 * time.Second
+
+// Webhook request headers.
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookSignatureHeader = "X-Webhook-Signature-256"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+type WebhookConfig struct {
+	URL string `mapstructure:"url"`
+	// Secret signs every request, the signature header carries "sha256="
+	// and the hex HMAC-SHA256 with the secret of the timestamp header, a
+	// "." and the body. Required.
+	Secret string `mapstructure:"secret"`
+	// Events are the webhook events sent, all of them when empty.
+	Events []string `mapstructure:"events"`
+	// Headers are added to every request, e.g. an API key.
+	Headers map[string]string `mapstructure:"headers"`
+	// A login_failure_burst is sent when a user failed FailureBurst
+	// password logins within FailureWindow, 5 within 5m when 0. Failed
+	// public keys do not count, clients try several keys on every login.
+	FailureBurst  int           `mapstructure:"failure_burst"`
+	FailureWindow time.Duration `mapstructure:"failure_window"`
+	// MaxRetries of a failed delivery, 5 when 0, the wait between two
+	// tries doubles from a second up to a minute.
+	MaxRetries int `mapstructure:"max_retries"`
+	// Timeout of one request, 10s when 0.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// QueueSize bounds the deliveries waiting to be sent, 1000 when 0.
+	// Events are dropped when the queue is full.
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+// WebhookPayload is the JSON body of a webhook request.
+type WebhookPayload struct {
+	ID    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Failures and Window of a login_failure_burst.
+	Failures int     `json:"failures,omitempty"`
+	Window   float64 `json:"window_seconds,omitempty"`
+	// Audit is the audit event that fired the webhook.
+	Audit Event `json:"audit"`
+}
+
+// WebhookSink posts webhook events to a url. Deliveries are queued and
+// sent in order in the background, so emitting never blocks.
+type WebhookSink struct {
+	url           string
+	secret        []byte
+	headers       map[string]string
+	events        map[string]bool
+	failureBurst  int
+	failureWindow time.Duration
+	maxRetries    int
+	client        *http.Client
+	queue         chan WebhookPayload
+	stop          chan struct{}
+	done          chan struct{}
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	closed   bool
+	logger   log.Logger
+}
+
+func NewWebhookSink(c WebhookConfig, logger log.Logger) (*WebhookSink, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("webhook url is not set")
+	}
+	if c.Secret == "" {
+		return nil, fmt.Errorf("webhook %s: secret is not set", c.URL)
+	}
+
+	s := &WebhookSink{url: c.URL,
+		secret:        []byte(c.Secret),
+		headers:       c.Headers,
+		events:        make(map[string]bool),
+		failureBurst:  c.FailureBurst,
+		failureWindow: c.FailureWindow,
+		maxRetries:    c.MaxRetries,
+		client:        &http.Client{Timeout: c.Timeout},
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		failures:      make(map[string][]time.Time),
+		logger:        logger}
+	if s.failureBurst <= 0 {
+		s.failureBurst = 5
+	}
+	if s.failureWindow <= 0 {
+		s.failureWindow = 5 * time.Minute
+	}
+	if s.maxRetries <= 0 {
+		s.maxRetries = 5
+	}
+	if s.client.Timeout <= 0 {
+		s.client.Timeout = 10 * time.Second
+	}
+	queueSize := c.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	s.queue = make(chan WebhookPayload, queueSize)
+
+	for _, event := range WebhookEvents {
+		s.events[event] = len(c.Events) == 0
+	}
+	for _, event := range c.Events {
+		if _, ok := s.events[event]; !ok {
+			return nil, fmt.Errorf("unknown webhook event %q", event)
+		}
+		s.events[event] = true
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *WebhookSink) Emit(e Event) {
+	payload := WebhookPayload{Time: e.Time, Audit: e}
+	failed := e.Success != nil && !*e.Success
+	switch {
+	case e.Type == EventAuthResult && !failed:
+		s.mu.Lock()
+		delete(s.failures, e.User)
+		s.mu.Unlock()
+		payload.Event = WebhookLoginSuccess
+	case e.Type == EventAuthResult && e.Method == "password":
+		n := s.countFailure(e.User, e.Time)
+		if n == 0 {
+			return
+		}
+		payload.Event = WebhookLoginFailureBurst
+		payload.Failures = n
+		payload.Window = s.failureWindow.Seconds()
+	case e.Type == EventSessionEnd:
+		payload.Event = WebhookSessionEnd
+	case e.Type == EventPolicy && failed:
+		payload.Event = WebhookPolicyDenied
+	default:
+		return
+	}
+	if !s.events[payload.Event] {
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	payload.ID = hex.EncodeToString(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- payload:
+	default:
+		s.logger.Warn(MODULENAME, fmt.Sprintf("Webhook queue of %s full, dropped %s event", s.url, payload.Event))
+	}
+}
+
+// countFailure records a failed login of a user, it returns the failures
+// within the window when they make a burst, and starts counting anew.
+func (s *WebhookSink) countFailure(user string, t time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	since := t.Add(-s.failureWindow)
+	recent := []time.Time{t}
+	for _, failure := range s.failures[user] {
+		if failure.After(since) {
+			recent = append(recent, failure)
+		}
+	}
+	// Forget the users whose failures are all outside their window.
+	for other, failures := range s.failures {
+		if len(failures) > 0 && !failures[len(failures)-1].After(since) {
+			delete(s.failures, other)
+		}
+	}
+
+	if len(recent) < s.failureBurst {
+		s.failures[user] = recent
+		return 0
+	}
+	delete(s.failures, user)
+	return len(recent)
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.done)
+
+	for payload := range s.queue {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			continue
+		}
+
+		backoff := time.Second
+		for try := 0; ; try++ {
+			retry, err := s.deliver(payload, body)
+			if err == nil {
+				break
+			}
+			select {
+			case <-s.stop:
+				// Closing, failed deliveries are not retried.
+				retry = false
+			default:
+			}
+			if !retry || try >= s.maxRetries {
+				s.logger.Error(MODULENAME, fmt.Sprintf("Webhook %s %s delivery %s failed: %s", s.url, payload.Event, payload.ID, err.Error()))
+				break
+			}
+			s.logger.Warn(MODULENAME, fmt.Sprintf("Webhook %s %s delivery %s get err: %s, retry in %s", s.url, payload.Event, payload.ID, err.Error(), backoff))
+
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// deliver posts one payload, it reports whether a failure is worth a retry.
+func (s *WebhookSink) deliver(payload WebhookPayload, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, payload.Event)
+	req.Header.Set(WebhookDeliveryHeader, payload.ID)
+	// Every try has its own timestamp, receivers can refuse old ones.
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(s.secret, timestamp, body))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+		return true, fmt.Errorf("answered %s", res.Status)
+	default:
+		return false, fmt.Errorf("answered %s", res.Status)
+	}
+}
+
+// WebhookSignature is the signature header value of a request, receivers
+// compute it with their copy of the secret and compare, and refuse
+// timestamps older than a few minutes, so a request cannot be replayed.
+func WebhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close sends what is queued, without retries, for at most webhookCloseTimeout.
+func (s *WebhookSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	close(s.queue)
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(webhookCloseTimeout):
+		return fmt.Errorf("webhook %s: %d deliveries not sent", s.url, len(s.queue))
+	}
+}
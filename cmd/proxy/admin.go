@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"jupyterhub-ssh-proxy/loglevel"
+	"jupyterhub-ssh-proxy/sshproxy"
+
+	"github.com/spf13/viper"
+)
+
+// adminClient talks to the admin socket of the running proxy.
+type adminClient struct {
+	client *http.Client
+	json   bool
+}
+
+// newAdminClient connects to socket, or to the proxy.admin_socket of the
+// config file when socket is empty.
+func newAdminClient(socket string, cfg string, asJSON bool) (*adminClient, error) {
+	if socket == "" {
+		v := viper.New()
+		v.SetConfigFile(cfg)
+		v.SetConfigType("yaml")
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("no --admin.socket and no config file: %s", err)
+		}
+		if socket = v.GetString("proxy.admin_socket"); socket == "" {
+			return nil, fmt.Errorf("proxy.admin_socket is not set in %s", cfg)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &adminClient{client: &http.Client{Timeout: 30 * time.Second,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}}},
+		json: asJSON}, nil
+}
+
+// do sends a request and decodes the JSON answer into v.
+func (c *adminClient) do(method string, path string, query url.Values, v interface{}) error {
+	u := "http://admin" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("%s", e.Error)
+		}
+		return fmt.Errorf("proxy answered %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (c *adminClient) printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func printSessions(w io.Writer, sessions []sshproxy.SessionInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tSERVER\tPOD\tREMOTE\tMETHOD\tSTARTED\tCHANNELS\tIN\tOUT")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", s.ID, dash(s.User), dash(s.Server), dash(s.Pod),
+			s.RemoteAddr, dash(s.AuthMethod), s.Start.Local().Format("2006-01-02 15:04:05"), s.Channels,
+			formatBytes(s.BytesIn), formatBytes(s.BytesOut))
+	}
+	tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (c *adminClient) listSessions(user string, pod string) int {
+	query := url.Values{}
+	if user != "" {
+		query.Set("user", user)
+	}
+	if pod != "" {
+		query.Set("pod", pod)
+	}
+
+	var sessions []sshproxy.SessionInfo
+	if err := c.do(http.MethodGet, "/admin/sessions", query, &sessions); err != nil {
+		fmt.Fprintf(os.Stderr, "Error list sessions: %s\n", err)
+		return 1
+	}
+
+	if c.json {
+		c.printJSON(sessions)
+	} else {
+		printSessions(os.Stdout, sessions)
+	}
+	return 0
+}
+
+func (c *adminClient) showSession(id string) int {
+	var s sshproxy.SessionInfo
+	if err := c.do(http.MethodGet, "/admin/sessions/"+url.PathEscape(id), nil, &s); err != nil {
+		fmt.Fprintf(os.Stderr, "Error show session: %s\n", err)
+		return 1
+	}
+
+	if c.json {
+		c.printJSON(s)
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", s.ID)
+	fmt.Fprintf(tw, "User:\t%s\n", dash(s.User))
+	fmt.Fprintf(tw, "Remote address:\t%s\n", s.RemoteAddr)
+	fmt.Fprintf(tw, "Login method:\t%s\n", dash(s.AuthMethod))
+	fmt.Fprintf(tw, "Server:\t%s\n", dash(s.Server))
+	fmt.Fprintf(tw, "Pod:\t%s\n", dash(s.Pod))
+	fmt.Fprintf(tw, "Pod IP:\t%s\n", dash(s.PodIP))
+	fmt.Fprintf(tw, "Started:\t%s (%s ago)\n", s.Start.Local().Format("2006-01-02 15:04:05"), time.Since(s.Start).Round(time.Second))
+	fmt.Fprintf(tw, "Channels:\t%d\n", s.Channels)
+	fmt.Fprintf(tw, "Bytes in:\t%s\n", formatBytes(s.BytesIn))
+	fmt.Fprintf(tw, "Bytes out:\t%s\n", formatBytes(s.BytesOut))
+	tw.Flush()
+	return 0
+}
+
+// killSessions kills one session by ID, or the sessions of a user or pod.
+func (c *adminClient) killSessions(id string, user string, pod string) int {
+	path := "/admin/sessions"
+	query := url.Values{}
+	switch {
+	case id != "" && (user != "" || pod != ""):
+		fmt.Fprintln(os.Stderr, "Error kill sessions: give a session ID or --user/--pod, not both")
+		return 1
+	case id != "":
+		path += "/" + url.PathEscape(id)
+	case user == "" && pod == "":
+		fmt.Fprintln(os.Stderr, "Error kill sessions: give a session ID, --user or --pod")
+		return 1
+	}
+	if user != "" {
+		query.Set("user", user)
+	}
+	if pod != "" {
+		query.Set("pod", pod)
+	}
+
+	var result sshproxy.KillResult
+	if err := c.do(http.MethodDelete, path, query, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error kill sessions: %s\n", err)
+		return 1
+	}
+
+	if c.json {
+		c.printJSON(result)
+		return 0
+	}
+	fmt.Printf("Killed %d sessions\n", len(result.Killed))
+	if len(result.Killed) > 0 {
+		printSessions(os.Stdout, result.Killed)
+	}
+	return 0
+}
+
+func (c *adminClient) blockUser(user string, d time.Duration, kill bool) int {
+	query := url.Values{}
+	if d > 0 {
+		query.Set("duration", d.String())
+	}
+	if kill {
+		query.Set("kill", "true")
+	}
+
+	var result sshproxy.BlockResult
+	if err := c.do(http.MethodPost, "/admin/users/"+url.PathEscape(user)+"/block", query, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error block user: %s\n", err)
+		return 1
+	}
+
+	if c.json {
+		c.printJSON(result)
+		return 0
+	}
+	if result.Until != nil {
+		fmt.Printf("Blocked %s until %s\n", result.User, result.Until.Local().Format("2006-01-02 15:04:05"))
+	} else {
+		fmt.Printf("Blocked %s until unblocked\n", result.User)
+	}
+	if kill {
+		fmt.Printf("Killed %d sessions\n", len(result.Killed))
+	}
+	return 0
+}
+
+func (c *adminClient) unblockUser(user string) int {
+	var result sshproxy.BlockResult
+	if err := c.do(http.MethodPost, "/admin/users/"+url.PathEscape(user)+"/unblock", nil, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error unblock user: %s\n", err)
+		return 1
+	}
+
+	if c.json {
+		c.printJSON(result)
+	} else if result.Lifted {
+		fmt.Printf("Unblocked %s\n", result.User)
+	} else {
+		fmt.Printf("%s was not blocked\n", result.User)
+	}
+	return 0
+}
+
+// logLevels shows the log levels, or sets or resets the level of a module,
+// the default level when module is empty.
+func (c *adminClient) logLevels(module string, level string, reset bool) int {
+	method := http.MethodGet
+	query := url.Values{}
+	switch {
+	case reset && level != "":
+		fmt.Fprintln(os.Stderr, "Error log level: give a level or --reset, not both")
+		return 1
+	case reset:
+		method = http.MethodDelete
+	case level != "":
+		method = http.MethodPost
+		query.Set("level", level)
+	}
+	if module != "" {
+		query.Set("module", module)
+	}
+
+	var levels loglevel.Levels
+	if err := c.do(method, "/admin/log-levels", query, &levels); err != nil {
+		fmt.Fprintf(os.Stderr, "Error log level: %s\n", err)
+		return 1
+	}
+
+	if c.json {
+		c.printJSON(levels)
+		return 0
+	}
+	modules := make([]string, 0, len(levels.Modules))
+	for m := range levels.Modules {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODULE\tLEVEL")
+	fmt.Fprintf(tw, "default\t%s\n", levels.Default)
+	for _, m := range modules {
+		fmt.Fprintf(tw, "%s\t%s\n", m, levels.Modules[m])
+	}
+	tw.Flush()
+	if levels.Debug {
+		fmt.Println("Debug is on for all modules by SIGUSR1, send it again to restore the levels")
+	}
+	return 0
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"jupyterhub-ssh-proxy/audit"
+	"jupyterhub-ssh-proxy/jupyterhubserver"
+	"jupyterhub-ssh-proxy/sshproxy"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// appConfig is the whole config file.
+type appConfig struct {
+	HostKeyPath string                                  `mapstructure:"host_key_path"`
+	JupyterHub  jupyterhubserver.JupyterHubServerConfig `mapstructure:"jupyterhub"`
+	Proxy       sshproxy.SshProxyServerConfig           `mapstructure:"proxy"`
+}
+
+// configProblem is a problem of the config, Key is the key path, e.g.
+// "jupyterhub.url", or a command line flag.
+type configProblem struct {
+	Key     string
+	Message string
+}
+
+func (p configProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Key, p.Message)
+}
+
+type configProblems []configProblem
+
+func (p *configProblems) add(key string, format string, args ...interface{}) {
+	*p = append(*p, configProblem{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// loadConfig reads the config file. It reports the keys it does not know
+// and the values that do not fit their key, and returns what it could read.
+func loadConfig(path string) (*appConfig, configProblems) {
+	var problems configProblems
+	c := &appConfig{}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		problems.add("--config.file", "cannot load %s: %s", path, err)
+		return c, problems
+	}
+
+	for _, key := range unknownKeys("", v.AllSettings(), reflect.TypeOf(*c)) {
+		problems.add(key, "unknown key")
+	}
+
+	if err := v.Unmarshal(c); err != nil {
+		// One line per field, e.g. "* error decoding 'proxy.drain_timeout':
+		// time: invalid duration "x"".
+		found := false
+		for _, line := range strings.Split(err.Error(), "\n") {
+			if !strings.HasPrefix(line, "* ") {
+				continue
+			}
+			found = true
+			parts := strings.SplitN(line, "'", 3)
+			if len(parts) == 3 {
+				problems.add(parts[1], "%s", strings.TrimLeft(strings.TrimPrefix(parts[2], ":"), " "))
+			} else {
+				problems.add("--config.file", "%s", strings.TrimPrefix(line, "* "))
+			}
+		}
+		if !found {
+			problems.add("--config.file", "%s", err)
+		}
+	}
+
+	return c, problems
+}
+
+// unknownKeys lists the keys of settings that no field of t takes.
+func unknownKeys(prefix string, settings map[string]interface{}, t reflect.Type) []string {
+	var unknown []string
+	for key, value := range settings {
+		path := prefix + key
+		field, ok := fieldByKey(t, key)
+		if !ok {
+			unknown = append(unknown, path)
+			continue
+		}
+
+		ft := field.Type
+		switch {
+		case ft.Kind() == reflect.Struct:
+			if m, ok := value.(map[string]interface{}); ok {
+				unknown = append(unknown, unknownKeys(path+".", m, ft)...)
+			}
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+			list, _ := value.([]interface{})
+			for i, item := range list {
+				if m, ok := item.(map[string]interface{}); ok {
+					unknown = append(unknown, unknownKeys(fmt.Sprintf("%s[%d].", path, i), m, ft.Elem())...)
+				}
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// fieldByKey finds the field a key decodes into, keys are matched like
+// mapstructure does, without regard to case.
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// validateConfig reports every problem of a config, listen is the ssh
+// address of the --listen flag.
+func validateConfig(c *appConfig, listen string) configProblems {
+	var problems configProblems
+
+	checkAddress(&problems, "--listen", listen)
+
+	if c.HostKeyPath == "" {
+		problems.add("host_key_path", "is not set")
+	} else {
+		checkPrivateKey(&problems, "host_key_path", c.HostKeyPath)
+	}
+
+	jh := c.JupyterHub
+	checkURL(&problems, "jupyterhub.url", jh.Url, true)
+	if jh.AdminToken == "" {
+		problems.add("jupyterhub.admin_token", "is not set")
+	}
+	if jh.ConnUser == "" {
+		problems.add("jupyterhub.conn_user", "is not set")
+	}
+	if jh.SshPort == "" {
+		problems.add("jupyterhub.ssh_port", "is not set")
+	} else {
+		checkPort(&problems, "jupyterhub.ssh_port", jh.SshPort)
+	}
+
+	p := c.Proxy
+	if p.SigningKeyPath != "" {
+		checkPrivateKey(&problems, "proxy.signing_key_path", p.SigningKeyPath)
+	}
+	if _, err := sshproxy.NewGlobalRequestPolicy(p.GlobalRequests); err != nil {
+		problems.add("proxy.global_requests", "%s", err)
+	}
+	if _, err := sshproxy.NewExecPolicy(p.ExecPolicy); err != nil {
+		problems.add("proxy.exec_policy", "%s", err)
+	}
+
+	rec := p.Recording
+	if rec.Enabled {
+		switch rec.Storage {
+		case "", "local":
+		case "s3":
+			checkURL(&problems, "proxy.recording.s3.endpoint", rec.S3.Endpoint, true)
+			if rec.S3.Bucket == "" {
+				problems.add("proxy.recording.s3.bucket", "is not set")
+			}
+		default:
+			problems.add("proxy.recording.storage", "unknown storage %q, use local or s3", rec.Storage)
+		}
+		if rec.PathTemplate != "" {
+			if _, err := template.New("path").Parse(rec.PathTemplate); err != nil {
+				problems.add("proxy.recording.path_template", "%s", err)
+			}
+		}
+	}
+	if rec.MaxSizeMB < 0 {
+		problems.add("proxy.recording.max_size_mb", "must not be negative")
+	}
+	if rec.RetentionDays < 0 {
+		problems.add("proxy.recording.retention_days", "must not be negative")
+	}
+
+	a := p.Audit
+	switch {
+	case a.Sign && a.Path == "":
+		problems.add("proxy.audit.sign", "is set but proxy.audit.path is empty")
+	case a.Sign && a.Path == "-":
+		problems.add("proxy.audit.sign", "the audit log on stdout cannot be signed")
+	}
+	if sl := a.Syslog; sl.Enabled {
+		switch sl.Network {
+		case "", "udp", "tcp", "tls":
+		default:
+			problems.add("proxy.audit.syslog.network", "unknown network %q, use udp, tcp or tls", sl.Network)
+		}
+		if sl.Address == "" {
+			problems.add("proxy.audit.syslog.address", "is not set")
+		}
+		if sl.Facility != "" && !audit.ValidSyslogFacility(sl.Facility) {
+			problems.add("proxy.audit.syslog.facility", "unknown facility %q", sl.Facility)
+		}
+		if sl.CAFile != "" {
+			if sl.Network != "tls" {
+				problems.add("proxy.audit.syslog.ca_file", "is set but proxy.audit.syslog.network is not tls")
+			}
+			checkReadable(&problems, "proxy.audit.syslog.ca_file", sl.CAFile)
+		}
+	}
+	for i, webhook := range a.Webhooks {
+		key := fmt.Sprintf("proxy.audit.webhooks[%d]", i)
+		checkURL(&problems, key+".url", webhook.URL, true)
+		if webhook.Secret == "" {
+			problems.add(key+".secret", "is not set")
+		}
+		for _, event := range webhook.Events {
+			if !contains(audit.WebhookEvents, event) {
+				problems.add(key+".events", "unknown event %q, use %s", event, strings.Join(audit.WebhookEvents, ", "))
+			}
+		}
+	}
+
+	if p.Shadow.Enabled && !p.Shadow.HubAdmins && len(p.Shadow.Users) == 0 && len(p.Shadow.Groups) == 0 {
+		problems.add("proxy.shadow.enabled", "is set but no one may shadow, set hub_admins, users or groups")
+	}
+	if p.Lockout.MaxFailures < 0 {
+		problems.add("proxy.lockout.max_failures", "must not be negative")
+	}
+	if p.Traffic.DailyWarnGB < 0 {
+		problems.add("proxy.traffic.daily_warn_gb", "must not be negative")
+	}
+
+	if p.HTTP.Listen != "" {
+		checkAddress(&problems, "proxy.http.listen", p.HTTP.Listen)
+		if p.HTTP.Listen == listen {
+			problems.add("proxy.http.listen", "is the ssh address of --listen")
+		}
+	} else if p.HTTP.AdminToken != "" {
+		problems.add("proxy.http.admin_token", "is set but proxy.http.listen is empty, the admin API needs the listener")
+	}
+	if p.DrainTimeout < 0 {
+		problems.add("proxy.drain_timeout", "must not be negative")
+	}
+
+	if p.Tracing.Enabled && p.Tracing.Endpoint != "" {
+		checkURL(&problems, "proxy.tracing.endpoint", p.Tracing.Endpoint, false)
+	}
+	if p.Activity.Interval < 0 {
+		problems.add("proxy.activity.interval", "must not be negative")
+	}
+	if p.Activity.RequestsPerSecond < 0 {
+		problems.add("proxy.activity.requests_per_second", "must not be negative")
+	}
+
+	return problems
+}
+
+func checkURL(problems *configProblems, key string, value string, required bool) {
+	if value == "" {
+		if required {
+			problems.add(key, "is not set")
+		}
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems.add(key, "%q is not an http or https url", value)
+	}
+}
+
+func checkPort(problems *configProblems, key string, value string) {
+	if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+		problems.add(key, "%q is not a port, use 1 to 65535", value)
+	}
+}
+
+func checkAddress(problems *configProblems, key string, value string) {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		problems.add(key, "%q is not a host:port address", value)
+		return
+	}
+	checkPort(problems, key, port)
+}
+
+func checkReadable(problems *configProblems, key string, path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		problems.add(key, "cannot read: %s", err)
+		return nil
+	}
+	return b
+}
+
+func checkPrivateKey(problems *configProblems, key string, path string) {
+	b := checkReadable(problems, key, path)
+	if b == nil {
+		return
+	}
+	if _, err := ssh.ParsePrivateKey(b); err != nil {
+		problems.add(key, "%s is not a private key: %s", path, err)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfig prints the problems of a config file, it asks the hub for
+// the owner of the admin token when checkHub is set.
+func checkConfig(path string, listen string, checkHub bool) int {
+	c, problems := loadConfig(path)
+	problems = append(problems, validateConfig(c, listen)...)
+
+	if checkHub && c.JupyterHub.Url != "" {
+		jh := jupyterhubserver.NewJupyterHubServer(c.JupyterHub, nopLogger{})
+		if err := jh.Check(); err != nil {
+			problems.add("jupyterhub.url", "hub check failed: %s", err)
+		} else {
+			fmt.Printf("Hub at %s accepts the admin token\n", c.JupyterHub.Url)
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s: OK\n", path)
+		return 0
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) == 1 {
+		fmt.Printf("%s: 1 problem\n", path)
+	} else {
+		fmt.Printf("%s: %d problems\n", path, len(problems))
+	}
+	return 1
+}
+
+// nopLogger drops the log lines of the hub client while checking.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, interface{}) {}
+func (nopLogger) Info(string, interface{})  {}
+func (nopLogger) Warn(string, interface{})  {}
+func (nopLogger) Error(string, interface{}) {}
+func (nopLogger) Panic(string, interface{}) {}
@@ -7,12 +7,15 @@ import (
 	"os/signal"
 	"syscall"
 
+	"jupyterhub-ssh-proxy/audit"
 	"jupyterhub-ssh-proxy/jupyterhubserver"
+	"jupyterhub-ssh-proxy/loglevel"
+	"jupyterhub-ssh-proxy/recorder"
 	"jupyterhub-ssh-proxy/sshproxy"
+	"jupyterhub-ssh-proxy/tracing"
 
 	zaplogger "github.com/lylelaii/golang_utils/logger/v1/zaplogger"
 	version "github.com/lylelaii/golang_utils/version/v1"
-	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
@@ -31,40 +34,126 @@ func run() int {
 		logLevel      = kingpin.Flag(zaplogger.LevelFlagName, zaplogger.LevelFlagHelp).Default("info").String()
 		logMaxBackups = kingpin.Flag(zaplogger.LogMaxBackupsFlagName, zaplogger.LogMaxBackupsFlagHelp).Default("5").Int()
 		logMaxDays    = kingpin.Flag(zaplogger.LogMaxDaysFlagName, zaplogger.LogMaxDaysFlagHelp).Default("30").Int()
+
+		_           = kingpin.Command("serve", "Run the ssh proxy. This is the default command.").Default()
+		replayCmd   = kingpin.Command("replay", "Play back a recorded session.")
+		replayFile  = replayCmd.Arg("file", "Recording file, .cast or .cast.gz.").Required().ExistingFile()
+		replaySpeed = replayCmd.Flag("speed", "Playback speed, 2 plays twice as fast.").Default("1").Float64()
+		replaySeek  = replayCmd.Flag("seek", "Start playing at this point of the recording, e.g. 1m30s.").Default("0s").Duration()
+		replayIdle  = replayCmd.Flag("idle-limit", "Cap pauses between events to this duration, 0 keeps them.").Default("0s").Duration()
+		replayDump  = replayCmd.Flag("dump", "Print the recording as plain text with timestamps instead of playing it.").Bool()
+		verifyCmd   = kingpin.Command("verify", "Check recordings and audit logs against their signed manifests.")
+		verifyPaths = verifyCmd.Arg("files", "Recording or audit log files.").Required().ExistingFiles()
+		verifyKey   = verifyCmd.Flag("key", "Public key the manifests must be signed with, e.g. the .pub of the signing key. Default is the signing key, or else the host key, of the config file.").ExistingFile()
+		checkCmd    = kingpin.Command("check-config", "Check the config file and report every problem.")
+		checkHub    = checkCmd.Flag("hub", "Also check that the hub answers and accepts the admin token.").Bool()
+
+		adminSocket = kingpin.Flag("admin.socket", "Admin socket of the running proxy for the sessions, users and log-level commands. Default is proxy.admin_socket of the config file.").String()
+		adminJSON   = kingpin.Flag("json", "Print JSON instead of a table for the sessions, users and log-level commands.").Bool()
+
+		sessionsCmd      = kingpin.Command("sessions", "Manage the sessions of the running proxy.")
+		sessionsListCmd  = sessionsCmd.Command("list", "List open sessions.")
+		sessionsListUser = sessionsListCmd.Flag("user", "Only sessions of this hub user.").String()
+		sessionsListPod  = sessionsListCmd.Flag("pod", "Only sessions to this pod, by name or IP.").String()
+		sessionsShowCmd  = sessionsCmd.Command("show", "Show a session.")
+		sessionsShowID   = sessionsShowCmd.Arg("id", "Session ID.").Required().String()
+		sessionsKillCmd  = sessionsCmd.Command("kill", "Kill a session, or all sessions of a user or pod.")
+		sessionsKillID   = sessionsKillCmd.Arg("id", "Session ID.").String()
+		sessionsKillUser = sessionsKillCmd.Flag("user", "Kill all sessions of this hub user.").String()
+		sessionsKillPod  = sessionsKillCmd.Flag("pod", "Kill all sessions to this pod, by name or IP.").String()
+
+		usersCmd         = kingpin.Command("users", "Block and unblock logins of hub users.")
+		usersBlockCmd    = usersCmd.Command("block", "Refuse every login of a user.")
+		usersBlockName   = usersBlockCmd.Arg("user", "Hub user.").Required().String()
+		usersBlockFor    = usersBlockCmd.Flag("duration", "Lift the block after this long, 0 blocks until unblocked.").Default("0s").Duration()
+		usersBlockKill   = usersBlockCmd.Flag("kill", "Also kill the open sessions of the user.").Bool()
+		usersUnblockCmd  = usersCmd.Command("unblock", "Lift a block or lockout of a user.")
+		usersUnblockName = usersUnblockCmd.Arg("user", "Hub user.").Required().String()
+
+		logLevelCmd    = kingpin.Command("log-level", "Show or change the log levels of the running proxy.")
+		logLevelLevel  = logLevelCmd.Arg("level", "New level, one of: [debug, info, warn, error]. Shows the levels when not given.").String()
+		logLevelModule = logLevelCmd.Flag("module", "Change only this module, e.g. jupyterhubserver or ssh-proxy.").String()
+		logLevelReset  = logLevelCmd.Flag("reset", "Let the module, or every module, log at the default level again.").Bool()
 	)
 
 	kingpin.Version(version.Print())
 	kingpin.CommandLine.GetFlag("help").Short('h')
-	kingpin.Parse()
 
-	viper.New()
-	viper.SetConfigFile(*cfg)
-	viper.SetConfigType("yaml")
-	if err := viper.ReadInConfig(); err != nil {
-		panic("Failed to load config")
+	command := kingpin.Parse()
+	switch command {
+	case replayCmd.FullCommand():
+		return replayRecording(*replayFile, recorder.ReplayOptions{Speed: *replaySpeed,
+			Seek:      *replaySeek,
+			IdleLimit: *replayIdle}, *replayDump)
+	case verifyCmd.FullCommand():
+		return verifyFiles(*verifyPaths, *verifyKey, *cfg)
+	case checkCmd.FullCommand():
+		return checkConfig(*cfg, *listen, *checkHub)
+	case sessionsListCmd.FullCommand(), sessionsShowCmd.FullCommand(), sessionsKillCmd.FullCommand(),
+		usersBlockCmd.FullCommand(), usersUnblockCmd.FullCommand(), logLevelCmd.FullCommand():
+		client, err := newAdminClient(*adminSocket, *cfg, *adminJSON)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+
+		switch command {
+		case sessionsListCmd.FullCommand():
+			return client.listSessions(*sessionsListUser, *sessionsListPod)
+		case sessionsShowCmd.FullCommand():
+			return client.showSession(*sessionsShowID)
+		case sessionsKillCmd.FullCommand():
+			return client.killSessions(*sessionsKillID, *sessionsKillUser, *sessionsKillPod)
+		case usersBlockCmd.FullCommand():
+			return client.blockUser(*usersBlockName, *usersBlockFor, *usersBlockKill)
+		case usersUnblockCmd.FullCommand():
+			return client.unblockUser(*usersUnblockName)
+		case logLevelCmd.FullCommand():
+			return client.logLevels(*logLevelModule, *logLevelLevel, *logLevelReset)
+		}
 	}
 
-	loggerConfig := zaplogger.ConfigZap(SERVERNAME, zaplogger.NewRunConf(*logLevel, *runMode, *logMaxBackups, *logMaxDays))
-	logger := zaplogger.NewZapSugarLogger(loggerConfig)
+	// zap logs everything, the levels are applied by module in logger so
+	// they can be changed while the proxy runs.
+	loggerConfig := zaplogger.ConfigZap(SERVERNAME, zaplogger.NewRunConf("debug", *runMode, *logMaxBackups, *logMaxDays))
+	logger, err := loglevel.NewLogger(zaplogger.NewZapSugarLogger(loggerConfig), *logLevel,
+		SERVERNAME, sshproxy.MODULERNAME, jupyterhubserver.MODULENAME, audit.MODULENAME, recorder.MODULENAME, tracing.MODULENAME)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --%s: %s\n", zaplogger.LevelFlagName, err)
+		return 1
+	}
 
-	var jhConfig jupyterhubserver.JupyterHubServerConfig
-	if err := viper.UnmarshalKey("jupyterhub", &jhConfig); err != nil {
-		logger.Error(SERVERNAME, fmt.Sprintf("Error load jupyterhub config: %s", err))
+	config, problems := loadConfig(*cfg)
+	problems = append(problems, validateConfig(config, *listen)...)
+	if len(problems) > 0 {
+		for _, p := range problems {
+			logger.Error(SERVERNAME, fmt.Sprintf("Invalid config %s", p))
+		}
+		logger.Error(SERVERNAME, fmt.Sprintf("%s has %d problems, see check-config", *cfg, len(problems)))
+		return 1
 	}
 
-	jhServer := jupyterhubserver.NewJupyterHubServer(jhConfig, logger)
+	jhServer := jupyterhubserver.NewJupyterHubServer(config.JupyterHub, logger)
 
-	privateBytes, err := ioutil.ReadFile(viper.GetString("host_key_path"))
+	privateBytes, err := ioutil.ReadFile(config.HostKeyPath)
 	if err != nil {
-		panic("Failed to load private key")
+		logger.Error(SERVERNAME, fmt.Sprintf("Error load host key: %s", err))
+		return 1
 	}
 
 	private, err := ssh.ParsePrivateKey(privateBytes)
 	if err != nil {
-		panic("Failed to parse private key")
+		logger.Error(SERVERNAME, fmt.Sprintf("Error parse host key %s: %s", config.HostKeyPath, err))
+		return 1
 	}
 
-	srv := sshproxy.NewSshProxyServer(*listen, private, jhServer, logger)
+	proxyConfig := config.Proxy
+	srv, err := sshproxy.NewSshProxyServer(proxyConfig, *listen, private, jhServer, logger)
+	if err != nil {
+		logger.Error(SERVERNAME, fmt.Sprintf("Error create ssh proxy server: %s", err))
+		return 1
+	}
+	srv.SetLogLevels(logger)
 
 	srvc := make(chan struct{})
 
@@ -75,22 +164,40 @@ func run() int {
 			logger.Error(SERVERNAME, fmt.Sprintf("Start Error: %s", err.Error()))
 			close(srvc)
 		}
+	}()
 
-		defer func() {
-			if err := srv.Close(); err != nil {
-				logger.Error(SERVERNAME, fmt.Sprintf("Error when closing server: %+v", err))
-			}
-		}()
+	go func() {
+		if err := srv.ListenAndServeHTTP(); err != nil {
+			logger.Error(SERVERNAME, fmt.Sprintf("HTTP listener error: %s", err.Error()))
+		}
+	}()
 
+	go func() {
+		if err := srv.ListenAndServeAdmin(); err != nil {
+			logger.Error(SERVERNAME, fmt.Sprintf("Admin socket error: %s", err.Error()))
+		}
 	}()
 
 	var (
 		hup      = make(chan os.Signal, 1)
 		hupReady = make(chan bool)
 		term     = make(chan os.Signal, 1)
+		usr1     = make(chan os.Signal, 1)
 	)
 	signal.Notify(hup, syscall.SIGHUP)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	go func() {
+		for range usr1 {
+			if logger.ToggleDebug() {
+				logger.Warn(SERVERNAME, "Received SIGUSR1, debug logging on for all modules")
+			} else {
+				levels := logger.Levels()
+				logger.Warn(SERVERNAME, fmt.Sprintf("Received SIGUSR1, debug logging off, default level %s", levels.Default))
+			}
+		}
+	}()
 
 	go func() {
 		<-hupReady
@@ -113,10 +220,20 @@ func run() int {
 		select {
 		case <-term:
 			logger.Info(SERVERNAME, "Received SIGTERM, exiting gracefully...")
+			srv.Drain(proxyConfig.DrainTimeout)
+			// Closing signs the final state of the audit log.
+			closeServer(srv, logger)
 			return 0
 		case <-srvc:
+			closeServer(srv, logger)
 			return 1
 		}
 	}
 
 }
+
+func closeServer(srv *sshproxy.SshProxyServer, logger *loglevel.Logger) {
+	if err := srv.Close(); err != nil {
+		logger.Error(SERVERNAME, fmt.Sprintf("Error when closing server: %+v", err))
+	}
+}
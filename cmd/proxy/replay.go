@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"jupyterhub-ssh-proxy/recorder"
+)
+
+// replayRecording plays a recording back on the terminal, or dumps it as
+// text with timestamps.
+func replayRecording(path string, opts recorder.ReplayOptions, dump bool) int {
+	cast, err := recorder.OpenCast(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error open recording: %s\n", err)
+		return 1
+	}
+	defer cast.Close()
+
+	if dump {
+		err = recorder.Dump(cast, os.Stdout)
+	} else {
+		fmt.Fprintf(os.Stderr, "Replaying %s (%dx%d), press Ctrl-C to stop.\n", cast.Header.Title, cast.Header.Width, cast.Header.Height)
+		err = recorder.Replay(cast, os.Stdout, opts)
+		// Leave the terminal in a sane state whatever the session did.
+		fmt.Fprint(os.Stdout, "\x1b[0m\x1b[?25h\r\n")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error replay recording: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
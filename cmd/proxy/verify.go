@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"jupyterhub-ssh-proxy/integrity"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// verifyFiles checks recordings and audit logs against their signed
+// manifests. The manifests have to be signed by the key at keyPath, or by
+// the signing key of the proxy, from the config file at cfgPath. Without
+// either, a manifest only proves the file was not changed since the key it
+// carries signed it, such files are reported as UNTRUSTED and fail.
+func verifyFiles(paths []string, keyPath string, cfgPath string) int {
+	if keyPath == "" {
+		keyPath = configSigningKey(cfgPath)
+	}
+
+	var trusted ssh.PublicKey
+	if keyPath != "" {
+		var err error
+		if trusted, err = readPublicKey(keyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error %s\n", err)
+			return 1
+		}
+	}
+
+	status := 0
+	for _, path := range paths {
+		result, err := integrity.VerifyFile(path, trusted)
+		if err != nil {
+			fmt.Printf("FAILED %s: %s\n", path, err)
+			status = 1
+			continue
+		}
+
+		m := result.Manifest
+		key, _ := m.Key()
+		state := "closed"
+		if !m.Complete {
+			state = "checkpoint"
+		}
+		verdict := "OK"
+		if trusted == nil {
+			// Anyone can re-sign an edited file with a key of their own.
+			verdict = "UNTRUSTED"
+			status = 1
+		}
+		fmt.Printf("%s %s: %d lines, %s %s signed by %s", verdict, path, m.Lines, state,
+			m.Time.Local().Format("2006-01-02 15:04:05"), ssh.FingerprintSHA256(key))
+		if trusted == nil {
+			fmt.Print(", no trusted key, use --key or a config file with the signing key")
+		}
+		if result.Unsigned > 0 {
+			fmt.Printf(", %d newer lines not signed yet", result.Unsigned)
+		}
+		fmt.Println()
+	}
+
+	return status
+}
+
+// configSigningKey returns the path of the key the proxy signs with, the
+// signing key or the host key of the config file, or "" when the config
+// file cannot be read.
+func configSigningKey(cfgPath string) string {
+	config, problems := loadConfig(cfgPath)
+	for _, p := range problems {
+		if p.Key == "--config.file" {
+			return ""
+		}
+	}
+
+	if config.Proxy.SigningKeyPath != "" {
+		return config.Proxy.SigningKeyPath
+	}
+	return config.HostKeyPath
+}
+
+// readPublicKey reads a public key, or the public key of a private key.
+func readPublicKey(path string) (ssh.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %s", err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err == nil {
+		return key, nil
+	}
+	// A private key will do as well.
+	signer, perr := ssh.ParsePrivateKey(b)
+	if perr != nil {
+		return nil, fmt.Errorf("parse key %s: %s", path, err)
+	}
+	return signer.PublicKey(), nil
+}
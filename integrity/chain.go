@@ -0,0 +1,76 @@
+// Package integrity makes recordings and audit logs tamper-evident. Every
+// line of a file is hash-chained, and a manifest holding the line count and
+// the last chain value is signed with a key of the proxy and kept next to
+// the file.
+package integrity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// Chain hashes lines as they are written: each chain value is the SHA-256
+// of the previous value followed by the line, newline included. A last line
+// without newline counts once the chain is closed.
+type Chain struct {
+	mu      sync.Mutex
+	sum     [sha256.Size]byte
+	lines   int64
+	bytes   int64
+	partial []byte
+}
+
+func NewChain() *Chain {
+	return &Chain{}
+}
+
+func (c *Chain) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			c.partial = append(c.partial, p...)
+			break
+		}
+
+		c.partial = append(c.partial, p[:i+1]...)
+		c.addLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (c *Chain) addLine() {
+	h := sha256.New()
+	h.Write(c.sum[:])
+	h.Write(c.partial)
+	copy(c.sum[:], h.Sum(nil))
+
+	c.lines++
+	c.bytes += int64(len(c.partial))
+	c.partial = c.partial[:0]
+}
+
+// Close counts a last line without newline.
+func (c *Chain) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.partial) > 0 {
+		c.addLine()
+	}
+	return nil
+}
+
+// State returns the number of complete lines, their size and the chain
+// value after the last of them.
+func (c *Chain) State() (int64, int64, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lines, c.bytes, hex.EncodeToString(c.sum[:])
+}
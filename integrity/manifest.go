@@ -0,0 +1,204 @@
+package integrity
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ManifestSuffix is added to the name of a file to name its manifest.
+const ManifestSuffix = ".sig"
+
+// Manifest is the signed state of a file. A complete manifest is written
+// when the file is closed, a file still being written, like the audit log,
+// gets checkpoints that cover the lines written so far.
+type Manifest struct {
+	File     string    `json:"file"`
+	Lines    int64     `json:"lines"`
+	Bytes    int64     `json:"bytes"`
+	Chain    string    `json:"chain"`
+	Complete bool      `json:"complete"`
+	Time     time.Time `json:"time"`
+
+	PublicKey       string `json:"public_key"`
+	SignatureFormat string `json:"signature_format"`
+	Signature       string `json:"signature"`
+}
+
+// NewManifest takes the state of a chain.
+func NewManifest(file string, chain *Chain, complete bool) *Manifest {
+	lines, size, sum := chain.State()
+	return &Manifest{File: filepath.Base(file),
+		Lines:    lines,
+		Bytes:    size,
+		Chain:    sum,
+		Complete: complete,
+		Time:     time.Now().UTC()}
+}
+
+// payload is what gets signed.
+func (m *Manifest) payload() []byte {
+	return []byte(fmt.Sprintf("jupyterhub-ssh-proxy manifest v1\n%s\n%d\n%d\n%s\n%t\n%s\n",
+		m.File, m.Lines, m.Bytes, m.Chain, m.Complete, m.Time.Format(time.RFC3339Nano)))
+}
+
+// Sign signs the manifest, RSA keys sign with SHA-256.
+func (m *Manifest) Sign(signer ssh.Signer) error {
+	var sig *ssh.Signature
+	var err error
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, m.payload(), ssh.SigAlgoRSASHA2256)
+	} else {
+		sig, err = signer.Sign(rand.Reader, m.payload())
+	}
+	if err != nil {
+		return err
+	}
+
+	m.PublicKey = string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	m.SignatureFormat = sig.Format
+	m.Signature = base64.StdEncoding.EncodeToString(sig.Blob)
+	return nil
+}
+
+// Key returns the public key that signed the manifest.
+func (m *Manifest) Key() (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(m.PublicKey))
+	return key, err
+}
+
+// VerifySignature checks the signature of the manifest, and that it was made
+// by trusted when trusted is not nil.
+func (m *Manifest) VerifySignature(trusted ssh.PublicKey) error {
+	key, err := m.Key()
+	if err != nil {
+		return fmt.Errorf("manifest public key: %s", err)
+	}
+	if trusted != nil && !bytes.Equal(key.Marshal(), trusted.Marshal()) {
+		return fmt.Errorf("manifest signed by %s, not by the trusted key %s", ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(trusted))
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("manifest signature: %s", err)
+	}
+	if err := key.Verify(m.payload(), &ssh.Signature{Format: m.SignatureFormat, Blob: blob}); err != nil {
+		return fmt.Errorf("manifest signature does not verify: %s", err)
+	}
+	return nil
+}
+
+func (m *Manifest) Marshal() []byte {
+	b, _ := json.MarshalIndent(m, "", "  ")
+	return append(b, '\n')
+}
+
+func ReadManifest(path string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("manifest %s: %s", path, err)
+	}
+	return &m, nil
+}
+
+// WriteManifestFile replaces the manifest at path, so a reader never sees
+// half of it.
+func WriteManifestFile(path string, m *Manifest) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, m.Marshal(), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Result of the verification of a file.
+type Result struct {
+	Manifest *Manifest
+	// Unsigned lines were written after the last checkpoint of a file
+	// that is still open.
+	Unsigned int64
+}
+
+// VerifyFile checks a file, gzip compressed or not, against its signed
+// manifest. It fails when the file was truncated or modified, when the
+// manifest was signed for another file, or when the manifest is not signed
+// by trusted, when trusted is not nil.
+func VerifyFile(path string, trusted ssh.PublicKey) (*Result, error) {
+	m, err := ReadManifest(path + ManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.VerifySignature(trusted); err != nil {
+		return nil, err
+	}
+	if m.File != filepath.Base(path) {
+		return nil, fmt.Errorf("manifest was signed for %s, not for %s", m.File, filepath.Base(path))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, err := r.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, err
+		}
+	}
+
+	chain := NewChain()
+	br := bufio.NewReader(r)
+	var signedChain string
+	if m.Lines == 0 {
+		_, _, signedChain = chain.State()
+	}
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			chain.Write(line)
+			if err != nil {
+				chain.Close()
+			}
+			if lines, _, sum := chain.State(); lines == m.Lines && signedChain == "" {
+				signedChain = sum
+			}
+		}
+		// A compressed file cut short ends at its last complete line.
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lines, _, _ := chain.State()
+	switch {
+	case lines < m.Lines:
+		return nil, fmt.Errorf("truncated: %d lines, %d were signed", lines, m.Lines)
+	case signedChain != m.Chain:
+		return nil, fmt.Errorf("modified: the signed lines do not match their hash chain")
+	case lines > m.Lines && m.Complete:
+		return nil, fmt.Errorf("modified: %d lines were added after the file was closed", lines-m.Lines)
+	}
+
+	return &Result{Manifest: m, Unsigned: lines - m.Lines}, nil
+}
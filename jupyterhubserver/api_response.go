@@ -18,8 +18,11 @@ type UserInfo struct {
 	Servers      Servers       `json:"servers,omitempty"`
 }
 
+// Servers embeds the default server and keeps every server of the user,
+// default and named, in All keyed by server name.
 type Servers struct {
 	ServerDetail `json:",omitempty"`
+	All          map[string]ServerDetail `json:"-"`
 }
 
 func (s *Servers) UnmarshalJSON(b []byte) error {
@@ -27,6 +30,7 @@ func (s *Servers) UnmarshalJSON(b []byte) error {
 	err := json.Unmarshal(b, &d)
 	if err == nil {
 		s.ServerDetail = d[""]
+		s.All = d
 	}
 	return err
 }
@@ -61,3 +65,18 @@ type UserRoute struct {
 		LastActivity time.Time `json:"last_activity"`
 	} `json:"data"`
 }
+
+// UserServer is a server of a user, running or stopped, combined from the
+// user model and the proxy routes.
+type UserServer struct {
+	Name    string
+	PodName string
+	PodIP   string
+	Profile string
+	Started time.Time
+	Ready   bool
+}
+
+func (s UserServer) Running() bool {
+	return s.Ready && s.PodIP != ""
+}
@@ -4,8 +4,13 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	"jupyterhub-ssh-proxy/tracing"
 
 	log "github.com/lylelaii/golang_utils/logger/v1"
 	requestes "github.com/lylelaii/golang_utils/requestes/v1"
@@ -32,7 +37,9 @@ type JupyterHubServer struct {
 	sshPort            string
 	authorizedKeysPath string
 	requestesClient    *requestes.RequestsClient
-	logger             log.Logger
+	// span is the parent of the spans of hub requests and pod logins.
+	span   *tracing.Span
+	logger log.Logger
 }
 
 func NewJupyterHubServer(c JupyterHubServerConfig, logger log.Logger) *JupyterHubServer {
@@ -47,6 +54,42 @@ func NewJupyterHubServer(c JupyterHubServerConfig, logger log.Logger) *JupyterHu
 		logger:             logger}
 }
 
+// WithSpan returns a copy whose requests are traced below span.
+func (s *JupyterHubServer) WithSpan(span *tracing.Span) *JupyterHubServer {
+	c := *s
+	c.span = span
+	return &c
+}
+
+// WithLogger returns a copy that logs to logger.
+func (s *JupyterHubServer) WithLogger(logger log.Logger) *JupyterHubServer {
+	c := *s
+	c.logger = logger
+	return &c
+}
+
+// startRequest starts the span of a hub request and adds its trace context
+// to the request headers.
+func (s *JupyterHubServer) startRequest(name string, method string, uri string, headers map[string]string) *tracing.Span {
+	span := s.span.Child(name, tracing.KindClient)
+	span.SetAttribute("http.request.method", method)
+	span.SetAttribute("url.full", uri)
+	if traceparent := span.Traceparent(); traceparent != "" {
+		headers["traceparent"] = traceparent
+	}
+	return span
+}
+
+func endRequest(span *tracing.Span, res requestes.ResponseData, err error) {
+	if err == nil {
+		span.SetAttribute("http.response.status_code", res.StatusCode)
+		if res.StatusCode >= http.StatusBadRequest {
+			err = fmt.Errorf("hub answered %s", res.Status)
+		}
+	}
+	span.End(err)
+}
+
 func (s *JupyterHubServer) GetConnUser() string {
 	return s.connUser
 }
@@ -59,14 +102,22 @@ func (s *JupyterHubServer) GetSshPort() string {
 	return s.sshPort
 }
 
-func (s *JupyterHubServer) queryUserInfo(username, password string) (bool, *UserInfo) {
+func (s *JupyterHubServer) queryUserInfo(username, password string, flags ...string) (bool, *UserInfo) {
 	var headers map[string]string = make(map[string]string)
 	headers["Authorization"] = fmt.Sprintf("token %s", password)
 	// headers["Accept"] = "application/jupyterhub-pagination+json"
 
-	uri := s.url + fmt.Sprintf("/users/%s", username)
+	uri := s.url + fmt.Sprintf("/users/%s", url.PathEscape(username))
+	if len(flags) > 0 {
+		uri += "?" + strings.Join(flags, "&")
+	}
 
+	span := s.startRequest("queryUserInfo", http.MethodGet, uri, headers)
+	span.SetAttribute("hub.user", username)
+	start := time.Now()
 	res, err := s.requestesClient.Get(uri, requestes.AddHeader(headers))
+	observeHubRequest("/users", start, res, err)
+	endRequest(span, res, err)
 	if err != nil {
 		s.logger.Warn(MODULENAME, fmt.Sprintf("queryUserInfo get err: %s", err.Error()))
 		return false, &UserInfo{}
@@ -92,22 +143,30 @@ func (s *JupyterHubServer) queryUserInfo(username, password string) (bool, *User
 
 }
 
-func (s *JupyterHubServer) queryUserRoute(username string) *UserRoute {
+// queryUserRoutes returns the proxy routes of all running servers of a user,
+// keyed by server name. The default server has the empty name.
+func (s *JupyterHubServer) queryUserRoutes(username string) map[string]UserRoute {
 	var headers map[string]string = make(map[string]string)
 	headers["Authorization"] = fmt.Sprintf("token %s", s.adminToken)
 	// headers["Accept"] = "application/jupyterhub-pagination+json"
 
 	uri := s.url + "/proxy"
+	routes := make(map[string]UserRoute)
 
+	span := s.startRequest("queryUserRoute", http.MethodGet, uri, headers)
+	span.SetAttribute("hub.user", username)
+	start := time.Now()
 	res, err := s.requestesClient.Get(uri, requestes.AddHeader(headers))
+	observeHubRequest("/proxy", start, res, err)
+	endRequest(span, res, err)
 	if err != nil {
 		s.logger.Warn(MODULENAME, fmt.Sprintf("queryUserRoute get err: %s", err.Error()))
-		return &UserRoute{}
+		return routes
 	}
 
 	if res.StatusCode != http.StatusOK {
 		s.logger.Info(MODULENAME, fmt.Sprintf("queryUserRoute get non 200 response code: %v", res.StatusCode))
-		return &UserRoute{}
+		return routes
 	}
 
 	s.logger.Debug(MODULENAME, fmt.Sprintf("queryUserRoute rep: %v", res.Text()))
@@ -116,29 +175,221 @@ func (s *JupyterHubServer) queryUserRoute(username string) *UserRoute {
 
 	if err != nil {
 		s.logger.Error(MODULENAME, fmt.Sprintf("queryUserRoute bindJson get err: %v", err.Error()))
-		return &UserRoute{}
+		return routes
+	}
+
+	for _, r := range userRoutes {
+		if r.Data.User == username {
+			routes[r.Data.ServerName] = r
+		}
 	}
 
-	userIndex := fmt.Sprintf("/user/%s/", username)
-	r := userRoutes[userIndex]
+	s.logger.Debug(MODULENAME, fmt.Sprintf("queryUserRoute %v : %v", username, routes))
 
-	s.logger.Debug(MODULENAME, fmt.Sprintf("queryUserRoute %v : %v", username, r))
+	return routes
 
+}
+
+func (s *JupyterHubServer) queryUserRoute(username string) *UserRoute {
+	r := s.queryUserRoutes(username)[""]
 	return &r
+}
 
+func podIPFromTarget(target string) string {
+	ipReg := `((2(5[0-5]|[0-4]\d))|[0-1]?\d{1,2})(\.((2(5[0-5]|[0-4]\d))|[0-1]?\d{1,2})){3}`
+	reg, _ := regexp.Compile(ipReg)
+	return string(reg.Find([]byte(target)))
 }
 
 func (s *JupyterHubServer) GetPodIP(username string) string {
 	userRoute := s.queryUserRoute(username)
 
-	target := userRoute.Target
-	ipReg := `((2(5[0-5]|[0-4]\d))|[0-1]?\d{1,2})(\.((2(5[0-5]|[0-4]\d))|[0-1]?\d{1,2})){3}`
-	reg, _ := regexp.Compile(ipReg)
-	podIP := reg.Find([]byte(target))
+	podIP := podIPFromTarget(userRoute.Target)
 
-	s.logger.Debug(MODULENAME, fmt.Sprintf("GetPodIP %s : %s", username, string(podIP)))
+	s.logger.Debug(MODULENAME, fmt.Sprintf("GetPodIP %s : %s", username, podIP))
 
-	return string(podIP)
+	return podIP
+}
+
+// GetUserServers lists the servers of a user, running and stopped, with the
+// default server first and named servers sorted by name.
+func (s *JupyterHubServer) GetUserServers(username string) []UserServer {
+	routes := s.queryUserRoutes(username)
+	_, userInfo := s.queryUserInfo(username, s.adminToken, "include_stopped_servers")
+
+	details := userInfo.Servers.All
+	if details == nil {
+		details = make(map[string]ServerDetail)
+	}
+	// Route without a server model, e.g. when the hub could not be asked
+	// for user info. It is still a running server.
+	for serverName := range routes {
+		if _, ok := details[serverName]; !ok {
+			details[serverName] = ServerDetail{Name: serverName, Ready: true}
+		}
+	}
+
+	servers := make([]UserServer, 0, len(details))
+	for serverName, detail := range details {
+		server := UserServer{Name: serverName,
+			PodName: detail.State.PodName,
+			Profile: detail.UserOptions.Profile,
+			Started: detail.Started,
+			Ready:   detail.Ready}
+		if server.PodName == "" && serverName == "" {
+			server.PodName = fmt.Sprintf("jupyter-%s", username)
+		}
+		if route, ok := routes[serverName]; ok {
+			server.PodIP = podIPFromTarget(route.Target)
+		}
+		servers = append(servers, server)
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+
+	s.logger.Debug(MODULENAME, fmt.Sprintf("GetUserServers %s : %v", username, servers))
+
+	return servers
+}
+
+// ResolvePodHost maps a symbolic host name used by a user, the pod name or
+// the server name of one of the user's running servers, to the pod IP.
+// It returns an empty string when host does not name any of them.
+func (s *JupyterHubServer) ResolvePodHost(username string, host string) string {
+	server, _ := s.ResolveServer(username, host)
+	return server.PodIP
+}
+
+// ResolveServer is ResolvePodHost returning the whole server.
+func (s *JupyterHubServer) ResolveServer(username string, host string) (UserServer, bool) {
+	for _, server := range s.GetUserServers(username) {
+		if !server.Running() {
+			continue
+		}
+
+		if host == server.PodName || (server.Name != "" && host == server.Name) {
+			s.logger.Debug(MODULENAME, fmt.Sprintf("ResolvePodHost %s %s : %s", username, host, server.PodIP))
+			return server, true
+		}
+	}
+
+	return UserServer{}, false
+}
+
+// Check asks the hub who owns the admin token, it fails when the hub does
+// not answer or does not accept the token.
+func (s *JupyterHubServer) Check() error {
+	var headers map[string]string = make(map[string]string)
+	headers["Authorization"] = fmt.Sprintf("token %s", s.adminToken)
+
+	start := time.Now()
+	res, err := s.requestesClient.Get(s.url+"/user", requestes.AddHeader(headers))
+	observeHubRequest("/user", start, res, err)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("hub answered %s", res.Status)
+	}
+	return nil
+}
+
+// StartServer asks the hub to spawn a server of a user, the default server
+// when serverName is empty.
+func (s *JupyterHubServer) StartServer(username string, serverName string) error {
+	var headers map[string]string = make(map[string]string)
+	headers["Authorization"] = fmt.Sprintf("token %s", s.adminToken)
+
+	uri := s.url + fmt.Sprintf("/users/%s/server", url.PathEscape(username))
+	if serverName != "" {
+		uri = s.url + fmt.Sprintf("/users/%s/servers/%s", url.PathEscape(username), url.PathEscape(serverName))
+	}
+
+	span := s.startRequest("StartServer", http.MethodPost, uri, headers)
+	span.SetAttribute("hub.user", username)
+	span.SetAttribute("hub.server", serverName)
+	start := time.Now()
+	res, err := s.requestesClient.Post(uri, requestes.JsonData(map[string]string{}), requestes.AddHeader(headers))
+	observeHubRequest("spawn", start, res, err)
+	endRequest(span, res, err)
+	if err != nil {
+		s.logger.Warn(MODULENAME, fmt.Sprintf("StartServer get err: %s", err.Error()))
+		return err
+	}
+
+	switch res.StatusCode {
+	case http.StatusCreated, http.StatusAccepted:
+		s.logger.Info(MODULENAME, fmt.Sprintf("StartServer %s %q: %s", username, serverName, res.Status))
+		return nil
+	default:
+		s.logger.Info(MODULENAME, fmt.Sprintf("StartServer get non 201 response code: %v", res.StatusCode))
+		return fmt.Errorf("hub refused to start server: %s", res.Status)
+	}
+}
+
+// activityTime is the timestamp format the hub parses, in UTC.
+const activityTime = "2006-01-02T15:04:05.000000Z"
+
+// ReportActivity tells the hub when the servers of a user, by server name,
+// were last active, so its idle culler sees activity outside of the web.
+func (s *JupyterHubServer) ReportActivity(username string, servers map[string]time.Time) error {
+	var headers map[string]string = make(map[string]string)
+	headers["Authorization"] = fmt.Sprintf("token %s", s.adminToken)
+
+	var last time.Time
+	serverActivity := make(map[string]map[string]string)
+	for serverName, t := range servers {
+		serverActivity[serverName] = map[string]string{"last_activity": t.UTC().Format(activityTime)}
+		if t.After(last) {
+			last = t
+		}
+	}
+	body := map[string]interface{}{"last_activity": last.UTC().Format(activityTime),
+		"servers": serverActivity}
+
+	uri := s.url + fmt.Sprintf("/users/%s/activity", url.PathEscape(username))
+	span := s.startRequest("ReportActivity", http.MethodPost, uri, headers)
+	span.SetAttribute("hub.user", username)
+	start := time.Now()
+	res, err := s.requestesClient.Post(uri, requestes.JsonData(body), requestes.AddHeader(headers))
+	observeHubRequest("activity", start, res, err)
+	endRequest(span, res, err)
+	if err != nil {
+		s.logger.Warn(MODULENAME, fmt.Sprintf("ReportActivity get err: %s", err.Error()))
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		s.logger.Info(MODULENAME, fmt.Sprintf("ReportActivity get non 200 response code: %v", res.StatusCode))
+		return fmt.Errorf("hub refused activity of %s: %s", username, res.Status)
+	}
+
+	s.logger.Debug(MODULENAME, fmt.Sprintf("ReportActivity %s : %v", username, serverActivity))
+	return nil
+}
+
+// WaitServerRunning polls the hub until the server of a user is ready and
+// routed, calling progress after every poll that did not find it.
+func (s *JupyterHubServer) WaitServerRunning(username string, serverName string, timeout time.Duration, progress func()) (UserServer, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, server := range s.GetUserServers(username) {
+			if server.Name == serverName && server.Running() {
+				return server, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return UserServer{}, fmt.Errorf("server %q of %s is not running after %s", serverName, username, timeout)
+		}
+
+		if progress != nil {
+			progress()
+		}
+		time.Sleep(2 * time.Second)
+	}
 }
 
 func (s *JupyterHubServer) CheckUser(username string, password string) bool {
@@ -147,6 +398,27 @@ func (s *JupyterHubServer) CheckUser(username string, password string) bool {
 	return auth
 }
 
+// GetUserGroups returns the names of the hub groups of a user.
+func (s *JupyterHubServer) GetUserGroups(username string) []string {
+	_, userInfo := s.queryUserInfo(username, s.adminToken)
+
+	groups := make([]string, 0, len(userInfo.Groups))
+	for _, group := range userInfo.Groups {
+		if name, ok := group.(string); ok {
+			groups = append(groups, name)
+		}
+	}
+
+	return groups
+}
+
+// IsAdmin reports whether a user is a JupyterHub admin.
+func (s *JupyterHubServer) IsAdmin(username string) bool {
+	_, userInfo := s.queryUserInfo(username, s.adminToken)
+
+	return userInfo.Admin
+}
+
 func (s *JupyterHubServer) CheckPod(username string) string {
 	_, userInfo := s.queryUserInfo(username, s.adminToken)
 	// fmt.Printf("%+v", userInfo)
@@ -155,7 +427,15 @@ func (s *JupyterHubServer) CheckPod(username string) string {
 	return podName
 }
 
-func (s *JupyterHubServer) GetUserAuthorizedKeys(podIP string) (map[string]bool, error) {
+func (s *JupyterHubServer) GetUserAuthorizedKeys(podIP string) (keys map[string]bool, err error) {
+	span := s.span.Child("GetUserAuthorizedKeys", tracing.KindClient)
+	span.SetAttribute("server.address", podIP)
+	span.SetAttribute("server.port", s.sshPort)
+	defer func() {
+		span.SetAttribute("authorized_keys", len(keys))
+		span.End(err)
+	}()
+
 	config := &ssh.ClientConfig{
 		User: s.connUser,
 		Auth: []ssh.AuthMethod{
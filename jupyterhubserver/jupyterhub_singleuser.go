@@ -1,8 +1,6 @@
 package jupyterhubserver
 
 import (
-	"fmt"
-
 	"golang.org/x/crypto/ssh"
 )
 
@@ -10,35 +8,136 @@ type SingleUser struct {
 	username          string
 	password          string
 	authorizedKeysMap map[string]bool
-	podName           string
-	podIP             string
+	groups            []string
+	servers           []UserServer
+	server            *UserServer
 	client            *ssh.Client
+	requests          <-chan *ssh.Request
 }
 
-func NewSingleUser(username string, password string, authorizedKeysMap map[string]bool, podIP string, client *ssh.Client) *SingleUser {
-	podName := fmt.Sprintf("jupyter-%s", username)
-	return &SingleUser{username: username,
+// NewSingleUser selects the server to connect to: the one named by
+// serverName, or the only running server when serverName is empty. When the
+// user has several running servers none is selected and SelectServer has to
+// be called once the user made a choice.
+func NewSingleUser(username string, password string, authorizedKeysMap map[string]bool, serverName string, servers []UserServer) *SingleUser {
+	u := &SingleUser{username: username,
 		password:          password,
 		authorizedKeysMap: authorizedKeysMap,
-		podName:           podName,
-		podIP:             podIP,
-		client:            client}
+		servers:           servers}
+
+	if serverName != "" {
+		u.SelectServer(serverName)
+		return u
+	}
+
+	var running []UserServer
+	for _, server := range servers {
+		if server.Running() {
+			running = append(running, server)
+		}
+	}
+	if len(running) == 1 {
+		u.server = &running[0]
+	}
+
+	return u
+}
+
+func (u *SingleUser) GetUsername() string {
+	return u.username
+}
+
+func (u *SingleUser) GetGroups() []string {
+	return u.groups
+}
+
+func (u *SingleUser) UpdateGroups(groups []string) {
+	u.groups = groups
 }
 
 func (u *SingleUser) GetClient() *ssh.Client {
 	return u.client
 }
 
+// GetRequests returns the connection-level requests sent by the user pod.
+func (u *SingleUser) GetRequests() <-chan *ssh.Request {
+	return u.requests
+}
+
 func (u *SingleUser) GetPodName() string {
-	return u.podName
+	if u.server == nil {
+		return ""
+	}
+	return u.server.PodName
+}
+
+func (u *SingleUser) GetServerName() string {
+	if u.server == nil {
+		return ""
+	}
+	return u.server.Name
 }
 
 func (u *SingleUser) GetPodIP() string {
-	return u.podIP
+	if u.server == nil {
+		return ""
+	}
+	return u.server.PodIP
+}
+
+func (u *SingleUser) GetServers() []UserServer {
+	return u.servers
+}
+
+// RunningServers counts the servers that can be connected to right away.
+func (u *SingleUser) RunningServers() int {
+	n := 0
+	for _, server := range u.servers {
+		if server.Running() {
+			n++
+		}
+	}
+	return n
+}
+
+// NeedsSelection reports whether the user has to pick one of several
+// running servers before a connection to a pod can be made.
+func (u *SingleUser) NeedsSelection() bool {
+	return u.server == nil && u.RunningServers() > 1
 }
 
-func (u *SingleUser) UpdateClient(client *ssh.Client) {
+// SelectServer selects a server by name, it returns false when the user has
+// no such server.
+func (u *SingleUser) SelectServer(name string) bool {
+	for i := range u.servers {
+		if u.servers[i].Name == name {
+			u.server = &u.servers[i]
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateServer replaces the state of a server, e.g. after it was started.
+func (u *SingleUser) UpdateServer(server UserServer) {
+	for i := range u.servers {
+		if u.servers[i].Name == server.Name {
+			u.servers[i] = server
+			u.server = &u.servers[i]
+			return
+		}
+	}
+	u.servers = append(u.servers, server)
+	u.server = &u.servers[len(u.servers)-1]
+}
+
+func (u *SingleUser) UpdateClient(client *ssh.Client, requests <-chan *ssh.Request) {
 	u.client = client
+	u.requests = requests
+}
+
+func (u *SingleUser) UpdateAuthorizedKeys(authorizedKeysMap map[string]bool) {
+	u.authorizedKeysMap = authorizedKeysMap
 }
 
 func (u *SingleUser) CheckAuthorizedKey(key string) bool {
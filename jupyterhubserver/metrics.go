@@ -0,0 +1,28 @@
+package jupyterhubserver
+
+import (
+	"strconv"
+	"time"
+
+	"jupyterhub-ssh-proxy/metrics"
+
+	requestes "github.com/lylelaii/golang_utils/requestes/v1"
+)
+
+var (
+	hubRequestSeconds = metrics.NewHistogramVec(metrics.Default, "jupyterhub_ssh_proxy_hub_request_duration_seconds",
+		"Latency of JupyterHub API requests, by endpoint.", nil, "endpoint")
+	hubRequests = metrics.NewCounterVec(metrics.Default, "jupyterhub_ssh_proxy_hub_requests_total",
+		"JupyterHub API requests, by endpoint and status code, error when there was no response.", "endpoint", "status")
+)
+
+// observeHubRequest records a hub API request that started at start.
+func observeHubRequest(endpoint string, start time.Time, res requestes.ResponseData, err error) {
+	hubRequestSeconds.With(endpoint).Observe(time.Since(start).Seconds())
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	hubRequests.With(endpoint, status).Inc()
+}
@@ -0,0 +1,201 @@
+// Package loglevel filters log lines by the level of their module, and lets
+// the levels be changed while the proxy runs.
+package loglevel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+	zaplogger "github.com/lylelaii/golang_utils/logger/v1/zaplogger"
+)
+
+// Levels are the log levels in effect, Modules has the modules with a
+// level of their own, the other modules log at Default.
+type Levels struct {
+	Default string            `json:"default"`
+	Modules map[string]string `json:"modules"`
+	// Debug is set while SIGUSR1 turned on debug for all modules.
+	Debug bool `json:"debug,omitempty"`
+}
+
+// Logger passes the lines of a module to the wrapped logger when they are
+// at or above the level of the module. Panic lines always pass.
+type Logger struct {
+	logger log.Logger
+	known  []string
+
+	mu      sync.RWMutex
+	def     zaplogger.Level
+	modules map[string]zaplogger.Level
+	// saved are the levels from before ToggleDebug turned debug on.
+	saved *Levels
+}
+
+// NewLogger wraps logger, modules are the modules that may get a level
+// of their own.
+func NewLogger(logger log.Logger, level string, modules ...string) (*Logger, error) {
+	def, err := parse(level)
+	if err != nil {
+		return nil, err
+	}
+
+	known := append([]string(nil), modules...)
+	sort.Strings(known)
+	return &Logger{logger: logger,
+		known:   known,
+		def:     def,
+		modules: make(map[string]zaplogger.Level)}, nil
+}
+
+func parse(level string) (zaplogger.Level, error) {
+	l := &zaplogger.LogLevel{}
+	if err := l.Set(level); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+	}
+	return l.Level(), nil
+}
+
+func name(level zaplogger.Level) string {
+	switch level {
+	case zaplogger.Debug:
+		return "debug"
+	case zaplogger.Info:
+		return "info"
+	case zaplogger.Warn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+func (l *Logger) enabled(module string, level zaplogger.Level) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	min, ok := l.modules[module]
+	if !ok {
+		min = l.def
+	}
+	return level >= min
+}
+
+// Levels returns the levels in effect.
+func (l *Logger) Levels() Levels {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	levels := Levels{Default: name(l.def), Modules: make(map[string]string), Debug: l.saved != nil}
+	for module, level := range l.modules {
+		levels.Modules[module] = name(level)
+	}
+	return levels
+}
+
+// SetLevel sets the level of a module, or the default level when module is
+// empty. It ends a debug turned on by ToggleDebug.
+func (l *Logger) SetLevel(module string, level string) error {
+	lv, err := parse(level)
+	if err != nil {
+		return err
+	}
+	if err := l.checkModule(module); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.saved = nil
+	if module == "" {
+		l.def = lv
+	} else {
+		l.modules[module] = lv
+	}
+	return nil
+}
+
+// ResetLevel lets a module log at the default level again, or every module
+// when module is empty.
+func (l *Logger) ResetLevel(module string) error {
+	if err := l.checkModule(module); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.saved = nil
+	if module == "" {
+		l.modules = make(map[string]zaplogger.Level)
+	} else {
+		delete(l.modules, module)
+	}
+	return nil
+}
+
+// ToggleDebug turns on debug for all modules, or when it is on, restores
+// the levels from before. It reports whether debug is on.
+func (l *Logger) ToggleDebug() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.saved != nil {
+		l.def, _ = parse(l.saved.Default)
+		l.modules = make(map[string]zaplogger.Level)
+		for module, level := range l.saved.Modules {
+			l.modules[module], _ = parse(level)
+		}
+		l.saved = nil
+		return false
+	}
+
+	saved := Levels{Default: name(l.def), Modules: make(map[string]string)}
+	for module, level := range l.modules {
+		saved.Modules[module] = name(level)
+	}
+	l.saved = &saved
+	l.def = zaplogger.Debug
+	l.modules = make(map[string]zaplogger.Level)
+	return true
+}
+
+func (l *Logger) checkModule(module string) error {
+	if module == "" {
+		return nil
+	}
+	for _, known := range l.known {
+		if known == module {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown module %q, use %s", module, strings.Join(l.known, ", "))
+}
+
+func (l *Logger) Debug(module string, data interface{}) {
+	if l.enabled(module, zaplogger.Debug) {
+		l.logger.Debug(module, data)
+	}
+}
+
+func (l *Logger) Info(module string, data interface{}) {
+	if l.enabled(module, zaplogger.Info) {
+		l.logger.Info(module, data)
+	}
+}
+
+func (l *Logger) Warn(module string, data interface{}) {
+	if l.enabled(module, zaplogger.Warn) {
+		l.logger.Warn(module, data)
+	}
+}
+
+func (l *Logger) Error(module string, data interface{}) {
+	if l.enabled(module, zaplogger.Error) {
+		l.logger.Error(module, data)
+	}
+}
+
+func (l *Logger) Panic(module string, data interface{}) {
+	l.logger.Panic(module, data)
+}
@@ -0,0 +1,302 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit latencies from a millisecond to half a minute.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Default is the registry the proxy serves.
+var Default = NewRegistry()
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// family holds the series of one metric, keyed by their label values.
+type family struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]*series
+}
+
+type series struct {
+	mu     sync.Mutex
+	labels []string
+	value  float64
+	// Histograms only.
+	buckets []float64
+	counts  []uint64
+	count   uint64
+}
+
+func newFamily(r *Registry, name string, help string, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+	r.register(name, f)
+	return f
+}
+
+func (f *family) with(values []string, buckets []float64) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...), buckets: buckets}
+		if buckets != nil {
+			s.counts = make([]uint64, len(buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labels, "\xff") < strings.Join(all[j].labels, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range all {
+		s.mu.Lock()
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labelString(f.labels, s.labels, "", ""), formatValue(s.value))
+		} else {
+			var cumulative uint64
+			for i, bound := range s.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.labels, "le", formatValue(bound)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labelString(f.labels, s.labels, "", ""), formatValue(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, labelString(f.labels, s.labels, "", ""), s.count)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func labelString(names []string, values []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct {
+	f *family
+}
+
+func NewCounterVec(r *Registry, name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: newFamily(r, name, help, "counter", labels)}
+}
+
+// With returns the counter of the given label values.
+func (c *CounterVec) With(values ...string) *Counter {
+	return &Counter{s: c.f.with(values, nil)}
+}
+
+type Counter struct {
+	s *series
+}
+
+// NewCounter returns a counter without labels.
+func NewCounter(r *Registry, name string, help string) *Counter {
+	return NewCounterVec(r, name, help).With()
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.s.mu.Lock()
+	c.s.value += v
+	c.s.mu.Unlock()
+}
+
+// GaugeVec is a gauge with labels.
+type GaugeVec struct {
+	f *family
+}
+
+func NewGaugeVec(r *Registry, name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: newFamily(r, name, help, "gauge", labels)}
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{s: g.f.with(values, nil)}
+}
+
+type Gauge struct {
+	s *series
+}
+
+func NewGauge(r *Registry, name string, help string) *Gauge {
+	return NewGaugeVec(r, name, help).With()
+}
+
+func (g *Gauge) Set(v float64) {
+	g.s.mu.Lock()
+	g.s.value = v
+	g.s.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.s.mu.Lock()
+	g.s.value += v
+	g.s.mu.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct {
+	f       *family
+	buckets []float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds, sorted
+// ascending, DefaultBuckets when nil.
+func NewHistogramVec(r *Registry, name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &HistogramVec{f: newFamily(r, name, help, "histogram", labels), buckets: buckets}
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{s: h.f.with(values, h.buckets)}
+}
+
+type Histogram struct {
+	s *series
+}
+
+func NewHistogram(r *Registry, name string, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(r, name, help, buckets).With()
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	for i, bound := range h.s.buckets {
+		if v <= bound {
+			h.s.counts[i]++
+			break
+		}
+	}
+	h.s.count++
+	h.s.value += v
+}
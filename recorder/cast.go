@@ -0,0 +1,190 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CastHeader is the first line of an asciinema v2 recording.
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+	// EventMarker ends a recording cut short by the size limit.
+	EventMarker = "m"
+)
+
+// Cast writes a session as an asciinema v2 recording, one JSON line per
+// event, straight to the underlying writer.
+type Cast struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+
+	header        CastHeader
+	headerWritten bool
+	start         time.Time
+	recordInput   bool
+
+	// Incomplete UTF-8 sequences at the end of a chunk, per event type.
+	partial map[string][]byte
+	err     error
+}
+
+func NewCast(w io.WriteCloser, title string, recordInput bool) *Cast {
+	now := time.Now()
+	return &Cast{w: w,
+		header: CastHeader{Version: 2,
+			Width:     80,
+			Height:    24,
+			Timestamp: now.Unix(),
+			Title:     title,
+			Env:       make(map[string]string)},
+		start:       now,
+		recordInput: recordInput,
+		partial:     make(map[string][]byte)}
+}
+
+// SetTerminal sets the terminal type and size from a pty-req. Once the
+// header is written the size change is recorded as a resize event.
+func (c *Cast) SetTerminal(term string, width int, height int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.headerWritten {
+		c.writeEvent(EventResize, []byte(resizeData(width, height)))
+		return
+	}
+
+	if term != "" {
+		c.header.Env["TERM"] = term
+	}
+	c.header.Width = width
+	c.header.Height = height
+}
+
+// Resize records a window-change.
+func (c *Cast) Resize(width int, height int) {
+	c.SetTerminal("", width, height)
+}
+
+func (c *Cast) Output(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeEvent(EventOutput, p)
+}
+
+// RecordsInput reports whether input recording is enabled.
+func (c *Cast) RecordsInput() bool {
+	return c.recordInput
+}
+
+// Input records what the user typed, when input recording is enabled.
+func (c *Cast) Input(p []byte) {
+	if !c.recordInput {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeEvent(EventInput, p)
+}
+
+func (c *Cast) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Cast) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader()
+	for eventType, rest := range c.partial {
+		if len(rest) > 0 {
+			c.writeLine([]interface{}{c.elapsed(), eventType, string(rest)})
+		}
+	}
+
+	if err := c.w.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	return c.err
+}
+
+func (c *Cast) elapsed() float64 {
+	return float64(time.Since(c.start).Microseconds()) / 1e6
+}
+
+func (c *Cast) writeHeader() {
+	if c.headerWritten {
+		return
+	}
+	c.headerWritten = true
+	c.writeLine(c.header)
+}
+
+func (c *Cast) writeEvent(eventType string, p []byte) {
+	c.writeHeader()
+
+	data := append(c.partial[eventType], p...)
+	complete, rest := splitUTF8(data)
+	c.partial[eventType] = append([]byte(nil), rest...)
+	if len(complete) == 0 {
+		return
+	}
+
+	c.writeLine([]interface{}{c.elapsed(), eventType, string(complete)})
+}
+
+func (c *Cast) writeLine(v interface{}) {
+	if c.err != nil {
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	if _, err := c.w.Write(append(b, '\n')); err != nil {
+		c.err = err
+		if err == ErrRecordingTooLarge {
+			// The size limit lets this last line through.
+			b, _ := json.Marshal([]interface{}{c.elapsed(), EventMarker, "recording truncated: " + err.Error()})
+			c.w.Write(append(b, '\n'))
+		}
+	}
+}
+
+func resizeData(width int, height int) string {
+	return fmt.Sprintf("%dx%d", width, height)
+}
+
+// splitUTF8 splits off an incomplete UTF-8 sequence at the end of p, so a
+// multi-byte character split across two reads ends up in one event.
+func splitUTF8(p []byte) ([]byte, []byte) {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i], p[i:]
+			}
+			break
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,242 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"jupyterhub-ssh-proxy/integrity"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+	"golang.org/x/crypto/ssh"
+)
+
+const MODULENAME = "recorder"
+
+const defaultPathTemplate = "{{.User}}/{{.Date}}/{{.Time}}-{{.ID}}.cast"
+
+type RecorderConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Users and Groups limit recording to these hub users and groups,
+	// everyone is recorded when both are empty.
+	Users       []string `mapstructure:"users"`
+	Groups      []string `mapstructure:"groups"`
+	RecordInput bool     `mapstructure:"record_input"`
+
+	// Storage is "local", recordings go to Dir, or "s3".
+	Storage string   `mapstructure:"storage"`
+	Dir     string   `mapstructure:"dir"`
+	S3      S3Config `mapstructure:"s3"`
+	// PathTemplate is a text/template for the path of a recording, with
+	// .User, .Server, .Date, .Time and .ID.
+	PathTemplate string `mapstructure:"path_template"`
+	// MaxSizeMB cuts recordings at this size before compression, 0 is
+	// unlimited.
+	MaxSizeMB int  `mapstructure:"max_size_mb"`
+	Compress  bool `mapstructure:"compress"`
+	// Sign hash-chains every recording and stores a manifest signed with
+	// the signing key of the proxy next to it, see the verify command.
+	Sign bool `mapstructure:"sign"`
+	// Recordings older than RetentionDays are purged every PurgeInterval.
+	RetentionDays int           `mapstructure:"retention_days"`
+	PurgeInterval time.Duration `mapstructure:"purge_interval"`
+}
+
+// RecordingInfo fills the path template of a recording.
+type RecordingInfo struct {
+	User   string
+	Server string
+	Date   string
+	Time   string
+	ID     string
+}
+
+type Recorder struct {
+	enabled      bool
+	users        map[string]bool
+	groups       map[string]bool
+	recordInput  bool
+	sink         Sink
+	pathTemplate *template.Template
+	maxSize      int64
+	compress     bool
+	signer       ssh.Signer
+	logger       log.Logger
+}
+
+// NewRecorder creates a recorder, signer signs the recordings when
+// c.Sign is set.
+func NewRecorder(c RecorderConfig, signer ssh.Signer, logger log.Logger) (*Recorder, error) {
+	r := &Recorder{enabled: c.Enabled,
+		users:       make(map[string]bool),
+		groups:      make(map[string]bool),
+		recordInput: c.RecordInput,
+		maxSize:     int64(c.MaxSizeMB) * 1024 * 1024,
+		compress:    c.Compress,
+		logger:      logger}
+
+	if c.Sign {
+		if signer == nil {
+			return nil, fmt.Errorf("recording signing needs a signing key")
+		}
+		r.signer = signer
+	}
+
+	for _, user := range c.Users {
+		r.users[user] = true
+	}
+	for _, group := range c.Groups {
+		r.groups[group] = true
+	}
+
+	if !r.enabled {
+		return r, nil
+	}
+
+	pathTemplate := c.PathTemplate
+	if pathTemplate == "" {
+		pathTemplate = defaultPathTemplate
+	}
+	t, err := template.New("path").Option("missingkey=error").Parse(pathTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("recording path template: %s", err)
+	}
+	r.pathTemplate = t
+
+	switch c.Storage {
+	case "", "local":
+		dir := c.Dir
+		if dir == "" {
+			dir = "./recordings"
+		}
+		r.sink = NewLocalSink(dir)
+	case "s3":
+		if r.sink, err = NewS3Sink(c.S3, logger); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown recording storage %q", c.Storage)
+	}
+
+	// Failed uploads to s3 are retried on the purge schedule.
+	_, retry := r.sink.(*S3Sink)
+	if c.RetentionDays > 0 || retry {
+		interval := c.PurgeInterval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		go r.purgeLoop(time.Duration(c.RetentionDays)*24*time.Hour, interval)
+	}
+
+	return r, nil
+}
+
+// ShouldRecord reports whether sessions of a user are recorded.
+func (r *Recorder) ShouldRecord(username string, groups []string) bool {
+	if !r.enabled {
+		return false
+	}
+
+	if len(r.users) == 0 && len(r.groups) == 0 {
+		return true
+	}
+
+	if r.users[username] {
+		return true
+	}
+	for _, group := range groups {
+		if r.groups[group] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathElement keeps user controlled values from escaping their directory.
+func pathElement(s string) string {
+	s = strings.NewReplacer("/", "_", "\\", "_").Replace(s)
+	if s == "" || s == "." || s == ".." {
+		s = "_" + s
+	}
+	return s
+}
+
+// Open starts a recording of a session of a user on one of their servers.
+func (r *Recorder) Open(username string, serverName string, title string) (*Cast, error) {
+	now := time.Now()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	info := RecordingInfo{User: pathElement(username),
+		Server: pathElement(serverName),
+		Date:   now.Format("2006-01-02"),
+		Time:   now.Format("150405"),
+		ID:     hex.EncodeToString(suffix)}
+
+	var b bytes.Buffer
+	if err := r.pathTemplate.Execute(&b, info); err != nil {
+		return nil, err
+	}
+	name := path.Clean("/" + b.String())[1:]
+	if r.compress {
+		name += ".gz"
+	}
+
+	var w io.WriteCloser
+	w, err := r.sink.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if r.compress {
+		w = newGzipWriter(w)
+	}
+	if r.maxSize > 0 {
+		w = &limitWriter{w: w, max: r.maxSize}
+	}
+	if r.signer != nil {
+		w = &signedWriter{w: w, chain: integrity.NewChain(), sink: r.sink, name: name, signer: r.signer}
+	}
+
+	r.logger.Info(MODULENAME, fmt.Sprintf("Recording session of %s to %s", username, name))
+
+	return NewCast(w, title, r.recordInput), nil
+}
+
+// purgeLoop removes the recordings older than retention, none when it is 0,
+// and uploads what is left in the s3 spool dir.
+func (r *Recorder) purgeLoop(retention time.Duration, interval time.Duration) {
+	for {
+		var before time.Time
+		if retention > 0 {
+			before = time.Now().Add(-retention)
+		}
+
+		if s3, ok := r.sink.(*S3Sink); ok {
+			uploaded, err := s3.Retry(before)
+			if err != nil {
+				r.logger.Error(MODULENAME, fmt.Sprintf("Retry recording uploads get err: %s", err.Error()))
+			}
+			if uploaded > 0 {
+				r.logger.Info(MODULENAME, fmt.Sprintf("Uploaded %d spooled recordings", uploaded))
+			}
+		}
+
+		if retention > 0 {
+			removed, err := r.sink.Purge(before)
+			if err != nil {
+				r.logger.Error(MODULENAME, fmt.Sprintf("Purge recordings get err: %s", err.Error()))
+			} else if removed > 0 {
+				r.logger.Info(MODULENAME, fmt.Sprintf("Purged %d recordings older than %s", removed, retention))
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
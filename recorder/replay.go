@@ -0,0 +1,294 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// CastEvent is one event line of a recording.
+type CastEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+// CastReader reads a recording written by Cast, compressed or not.
+type CastReader struct {
+	Header CastHeader
+
+	closer  io.Closer
+	scanner *bufio.Scanner
+}
+
+// OpenCast opens a recording file, gzip compressed recordings are detected
+// by their content.
+func OpenCast(path string) (*CastReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewCastReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closer = f
+	return r, nil
+}
+
+func NewCastReader(r io.Reader) (*CastReader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	} else {
+		r = br
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	c := &CastReader{scanner: scanner}
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("empty recording")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &c.Header); err != nil {
+		return nil, fmt.Errorf("recording header: %s", err)
+	}
+	if c.Header.Version != 2 {
+		return nil, fmt.Errorf("unsupported recording version %d", c.Header.Version)
+	}
+
+	return c, nil
+}
+
+// Next returns the next event, or io.EOF at the end of the recording. A
+// recording cut short, e.g. while its session is still running, ends at
+// its last complete event.
+func (c *CastReader) Next() (CastEvent, error) {
+	for c.scanner.Scan() {
+		line := bytes.TrimSpace(c.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var fields []interface{}
+		if err := json.Unmarshal(line, &fields); err != nil {
+			return CastEvent{}, io.EOF
+		}
+		if len(fields) != 3 {
+			return CastEvent{}, fmt.Errorf("malformed event %s", line)
+		}
+
+		t, ok1 := fields[0].(float64)
+		eventType, ok2 := fields[1].(string)
+		data, ok3 := fields[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return CastEvent{}, fmt.Errorf("malformed event %s", line)
+		}
+		return CastEvent{Time: t, Type: eventType, Data: data}, nil
+	}
+
+	if err := c.scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return CastEvent{}, err
+	}
+	return CastEvent{}, io.EOF
+}
+
+func (c *CastReader) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+type ReplayOptions struct {
+	// Speed multiplies the playback speed, 1 is real time.
+	Speed float64
+	// Seek skips to this point of the recording, what came before is
+	// printed at once so the screen is in the state it had.
+	Seek time.Duration
+	// IdleLimit caps the pauses between events, 0 keeps them as recorded.
+	IdleLimit time.Duration
+}
+
+// Replay plays the terminal output of a recording to w with its timing.
+func Replay(c *CastReader, w io.Writer, opts ReplayOptions) error {
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	seek := opts.Seek.Seconds()
+
+	last := seek
+	for {
+		event, err := c.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if event.Type != EventOutput {
+			continue
+		}
+
+		if event.Time > seek {
+			wait := time.Duration((event.Time - last) / speed * float64(time.Second))
+			if opts.IdleLimit > 0 && wait > opts.IdleLimit {
+				wait = opts.IdleLimit
+			}
+			time.Sleep(wait)
+			last = event.Time
+		}
+
+		if _, err := io.WriteString(w, event.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// Dump writes a recording as plain text, each line of output prefixed with
+// the time it started. Input and resize events get lines of their own, and
+// end the output line they interrupt.
+func Dump(c *CastReader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	fmt.Fprintf(bw, "# %s %dx%d %s\n", time.Unix(c.Header.Timestamp, 0).Format(time.RFC3339),
+		c.Header.Width, c.Header.Height, c.Header.Title)
+
+	var line strings.Builder
+	lineStart := 0.0
+	flush := func() {
+		fmt.Fprintf(bw, "%s  %s\n", dumpTime(lineStart), line.String())
+		line.Reset()
+	}
+
+	for {
+		event, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch event.Type {
+		case EventOutput:
+			for _, text := range strings.SplitAfter(plainText(event.Data), "\n") {
+				if text == "" {
+					continue
+				}
+				if line.Len() == 0 {
+					lineStart = event.Time
+				}
+				if strings.HasSuffix(text, "\n") {
+					line.WriteString(strings.TrimSuffix(text, "\n"))
+					flush()
+				} else {
+					line.WriteString(text)
+				}
+			}
+		case EventInput:
+			if line.Len() > 0 {
+				flush()
+			}
+			fmt.Fprintf(bw, "%s  > %q\n", dumpTime(event.Time), event.Data)
+		case EventResize:
+			if line.Len() > 0 {
+				flush()
+			}
+			fmt.Fprintf(bw, "%s  # resize %s\n", dumpTime(event.Time), event.Data)
+		case EventMarker:
+			if line.Len() > 0 {
+				flush()
+			}
+			fmt.Fprintf(bw, "%s  # %s\n", dumpTime(event.Time), event.Data)
+		}
+	}
+
+	if line.Len() > 0 {
+		flush()
+	}
+	return nil
+}
+
+func dumpTime(t float64) string {
+	d := time.Duration(t * float64(time.Second))
+	return fmt.Sprintf("[%02d:%02d:%06.3f]", d/time.Hour, d%time.Hour/time.Minute, (d % time.Minute).Seconds())
+}
+
+const (
+	textPlain = iota
+	textEscape
+	textCSI
+	textOSC
+	// One more character ends the sequence, e.g. a charset selection.
+	textFinal
+)
+
+// plainText drops terminal escape sequences and control characters but
+// newlines and tabs, and applies backspaces.
+func plainText(s string) string {
+	var b []rune
+	state := textPlain
+	for _, r := range s {
+		switch state {
+		case textEscape:
+			switch r {
+			case '[':
+				state = textCSI
+			case ']':
+				state = textOSC
+			case '(', ')', 'O', '#':
+				state = textFinal
+			default:
+				state = textPlain
+			}
+			continue
+		case textCSI:
+			if r >= 0x40 && r <= 0x7e {
+				state = textPlain
+			}
+			continue
+		case textOSC:
+			// OSC sequences end with BEL or ESC \.
+			if r == 0x07 {
+				state = textPlain
+			} else if r == 0x1b {
+				state = textEscape
+			}
+			continue
+		case textFinal:
+			state = textPlain
+			continue
+		}
+
+		switch {
+		case r == 0x1b:
+			state = textEscape
+		case r == '\b':
+			if len(b) > 0 && b[len(b)-1] != '\n' {
+				b = b[:len(b)-1]
+			}
+		case r == '\n' || r == '\t' || r >= 0x20 && r != 0x7f:
+			b = append(b, r)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,402 @@
+package recorder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+)
+
+type S3Config struct {
+	// Endpoint is the base url of the object storage, e.g.
+	// http://127.0.0.1:9000 for a local MinIO.
+	Endpoint  string `mapstructure:"endpoint"`
+	Bucket    string `mapstructure:"bucket"`
+	Region    string `mapstructure:"region"`
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	Prefix    string `mapstructure:"prefix"`
+	// SpoolDir holds recordings until they are uploaded on close, and the
+	// ones whose upload failed until it is retried, ./spool when empty.
+	SpoolDir string `mapstructure:"spool_dir"`
+}
+
+const defaultSpoolDir = "./spool"
+
+// spoolSuffix ends the name of a spooled recording, the name is the escaped
+// object key, so a failed upload can be retried.
+const spoolSuffix = ".spool"
+
+// S3Sink stores recordings in an S3-compatible bucket, using path-style
+// requests signed with AWS signature version 4.
+type S3Sink struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	spoolDir  string
+	client    *http.Client
+	logger    log.Logger
+
+	mu sync.Mutex
+	// open are the spool files still being written.
+	open map[string]bool
+}
+
+func NewS3Sink(c S3Config, logger log.Logger) (*S3Sink, error) {
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %s", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %q is not an absolute url", c.Endpoint)
+	}
+	if c.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not set")
+	}
+
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	spoolDir := c.SpoolDir
+	if spoolDir == "" {
+		spoolDir = defaultSpoolDir
+	}
+
+	return &S3Sink{endpoint: endpoint,
+		bucket:    c.Bucket,
+		region:    region,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		prefix:    strings.Trim(c.Prefix, "/"),
+		spoolDir:  spoolDir,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		logger:    logger,
+		open:      make(map[string]bool)}, nil
+}
+
+func (s *S3Sink) key(path string) string {
+	if s.prefix == "" {
+		return path
+	}
+	return s.prefix + "/" + path
+}
+
+func (s *S3Sink) Create(path string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(s.spoolDir, 0750); err != nil {
+		return nil, err
+	}
+
+	key := s.key(path)
+	name := filepath.Join(s.spoolDir, url.PathEscape(key)+spoolSuffix)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.open[name] = true
+	s.mu.Unlock()
+	return &s3Object{sink: s, key: key, file: f, hash: sha256.New()}, nil
+}
+
+// s3Object spools a recording to disk and uploads it on close.
+type s3Object struct {
+	sink *S3Sink
+	key  string
+	file *os.File
+	hash hash.Hash
+	size int64
+}
+
+func (o *s3Object) Write(p []byte) (int, error) {
+	n, err := o.file.Write(p)
+	o.hash.Write(p[:n])
+	o.size += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Close() error {
+	defer func() {
+		o.sink.mu.Lock()
+		delete(o.sink.open, o.file.Name())
+		o.sink.mu.Unlock()
+	}()
+
+	if _, err := o.file.Seek(0, io.SeekStart); err != nil {
+		o.file.Close()
+		return err
+	}
+
+	err := o.sink.put(o.key, o.file, o.size, hex.EncodeToString(o.hash.Sum(nil)))
+	o.file.Close()
+	if err != nil {
+		o.sink.logger.Error(MODULENAME, fmt.Sprintf("Upload of %s failed, recording kept in %s until the next purge: %s", o.key, o.file.Name(), err.Error()))
+		return err
+	}
+
+	return os.Remove(o.file.Name())
+}
+
+// Retry uploads the recordings left in the spool dir by failed uploads, or
+// by a proxy that stopped while they were written. The ones last modified
+// before t are removed instead. It returns how many were uploaded.
+func (s *S3Sink) Retry(before time.Time) (int, error) {
+	files, err := ioutil.ReadDir(s.spoolDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	uploaded := 0
+	for _, info := range files {
+		name := filepath.Join(s.spoolDir, info.Name())
+		key, kerr := url.PathUnescape(strings.TrimSuffix(info.Name(), spoolSuffix))
+		s.mu.Lock()
+		open := s.open[name]
+		s.mu.Unlock()
+		if info.IsDir() || !strings.HasSuffix(info.Name(), spoolSuffix) || kerr != nil || open {
+			continue
+		}
+
+		if info.ModTime().Before(before) {
+			s.logger.Warn(MODULENAME, fmt.Sprintf("Recording %s was never uploaded and is past retention, removed", key))
+			if rerr := os.Remove(name); rerr != nil {
+				err = rerr
+			}
+			continue
+		}
+
+		if uerr := s.upload(key, name); uerr != nil {
+			err = uerr
+			continue
+		}
+		s.logger.Info(MODULENAME, fmt.Sprintf("Uploaded %s from %s", key, name))
+		uploaded++
+	}
+	return uploaded, err
+}
+
+// upload puts a spool file under key and removes it.
+func (s *S3Sink) upload(key string, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.put(key, f, size, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+func (s *S3Sink) put(key string, body io.Reader, size int64, payloadHash string) error {
+	req, err := s.newRequest(http.MethodPut, key, nil, body, payloadHash)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	return s.do(req, nil)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Sink) Purge(before time.Time) (int, error) {
+	removed := 0
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest(http.MethodGet, "", query, nil, emptyPayloadHash)
+		if err != nil {
+			return removed, err
+		}
+		var result listBucketResult
+		if err := s.do(req, &result); err != nil {
+			return removed, err
+		}
+
+		for _, object := range result.Contents {
+			if !object.LastModified.Before(before) {
+				continue
+			}
+			req, err := s.newRequest(http.MethodDelete, object.Key, nil, nil, emptyPayloadHash)
+			if err != nil {
+				return removed, err
+			}
+			if err := s.do(req, nil); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+
+		if !result.IsTruncated {
+			return removed, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Sink) do(req *http.Request, result interface{}) error {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(body)))
+	}
+
+	if result != nil {
+		return xml.Unmarshal(body, result)
+	}
+	return nil
+}
+
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// newRequest builds a path-style request for an object, or for the bucket
+// when key is empty, signed with AWS signature version 4.
+func (s *S3Sink) newRequest(method string, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{method,
+		u.RawPath,
+		u.RawQuery,
+		"host:" + u.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), s.region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+
+	return req, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode percent-encodes everything but the unreserved characters of
+// RFC 3986, and '/' unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,177 @@
+package recorder
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"jupyterhub-ssh-proxy/integrity"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Sink stores recordings under slash separated paths.
+type Sink interface {
+	// Create starts a new recording at path. The recording is complete
+	// once the returned writer is closed.
+	Create(path string) (io.WriteCloser, error)
+	// Purge removes the recordings last modified before t and returns how
+	// many were removed.
+	Purge(before time.Time) (int, error)
+}
+
+// LocalSink stores recordings in a local directory.
+type LocalSink struct {
+	dir string
+}
+
+func NewLocalSink(dir string) *LocalSink {
+	return &LocalSink{dir: dir}
+}
+
+func (s *LocalSink) Create(path string) (io.WriteCloser, error) {
+	path = filepath.Join(s.dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+}
+
+func (s *LocalSink) Purge(before time.Time) (int, error) {
+	removed := 0
+	var dirs []string
+
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != s.dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if info.ModTime().Before(before) {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	// Deepest directories come last, remove the ones left empty.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+
+	return removed, err
+}
+
+var ErrRecordingTooLarge = errors.New("recording size limit reached")
+
+// limitWriter refuses any write that would take the recording over max
+// bytes, counted before compression. Writes are whole lines, so the
+// recording stays well-formed. Once a write was refused one more line is
+// let through, for the cast to tell it was cut short.
+type limitWriter struct {
+	w       io.WriteCloser
+	max     int64
+	written int64
+	full    bool
+	final   bool
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.full && !l.final {
+		l.final = true
+		return l.w.Write(p)
+	}
+	if l.full || l.written+int64(len(p)) > l.max {
+		l.full = true
+		return 0, ErrRecordingTooLarge
+	}
+
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+func (l *limitWriter) Close() error {
+	return l.w.Close()
+}
+
+// gzipWriter compresses into w and closes both.
+type gzipWriter struct {
+	*gzip.Writer
+	w io.WriteCloser
+}
+
+func newGzipWriter(w io.WriteCloser) *gzipWriter {
+	return &gzipWriter{Writer: gzip.NewWriter(w), w: w}
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	n, err := g.Writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	// Keep what is on disk readable while the session is still running.
+	return n, g.Writer.Flush()
+}
+
+func (g *gzipWriter) Close() error {
+	err := g.Writer.Close()
+	if cerr := g.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// signedWriter hash-chains the lines of a recording and, once it is closed,
+// stores its signed manifest next to it.
+type signedWriter struct {
+	w      io.WriteCloser
+	chain  *integrity.Chain
+	sink   Sink
+	name   string
+	signer ssh.Signer
+}
+
+func (s *signedWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.chain.Write(p[:n])
+	return n, err
+}
+
+func (s *signedWriter) Close() error {
+	err := s.w.Close()
+	s.chain.Close()
+
+	m := integrity.NewManifest(s.name, s.chain, true)
+	if serr := m.Sign(s.signer); serr != nil {
+		if err == nil {
+			err = serr
+		}
+		return err
+	}
+
+	mw, serr := s.sink.Create(s.name + integrity.ManifestSuffix)
+	if serr == nil {
+		_, serr = mw.Write(m.Marshal())
+		if cerr := mw.Close(); serr == nil {
+			serr = cerr
+		}
+	}
+	if err == nil {
+		err = serr
+	}
+	return err
+}
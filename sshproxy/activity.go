@@ -0,0 +1,155 @@
+package sshproxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"jupyterhub-ssh-proxy/jupyterhubserver"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+)
+
+// ActivityConfig reports the activity of SSH sessions to JupyterHub, so the
+// idle culler does not stop servers that are only used over SSH.
+type ActivityConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Interval between two reports of a user, 5m when 0.
+	Interval time.Duration `mapstructure:"interval"`
+	// RequestsPerSecond limits the activity requests sent to the hub, 10
+	// when 0.
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+}
+
+// activityReporter posts the last activity of every server with an SSH
+// session to the hub, one request per user with all of its servers, once
+// per interval and only when there was traffic since the last report.
+type activityReporter struct {
+	interval time.Duration
+	pace     time.Duration
+	// next is the earliest time of the next request.
+	next     time.Time
+	sessions *sessionRegistry
+	jhserver *jupyterhubserver.JupyterHubServer
+	// reported is the activity the hub knows of, by user and server name.
+	reported map[string]map[string]time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+	logger   log.Logger
+}
+
+// newActivityReporter returns nil when reporting is disabled.
+func newActivityReporter(c ActivityConfig, sessions *sessionRegistry, jhserver *jupyterhubserver.JupyterHubServer, logger log.Logger) *activityReporter {
+	if !c.Enabled {
+		return nil
+	}
+
+	r := &activityReporter{interval: c.Interval,
+		sessions: sessions,
+		jhserver: jhserver,
+		reported: make(map[string]map[string]time.Time),
+		stop:     make(chan struct{}),
+		logger:   logger}
+	if r.interval <= 0 {
+		r.interval = 5 * time.Minute
+	}
+	rps := c.RequestsPerSecond
+	if rps <= 0 {
+		rps = 10
+	}
+	r.pace = time.Duration(float64(time.Second) / rps)
+
+	go r.loop()
+	return r
+}
+
+func (r *activityReporter) loop() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.report()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// pending collects the activity of the open sessions the hub does not know
+// of yet, by user and server name.
+func (r *activityReporter) pending() map[string]map[string]time.Time {
+	active := make(map[string]map[string]time.Time)
+	for _, sess := range r.sessions.list() {
+		user, server, last := sess.activity()
+		if user == "" || last.IsZero() {
+			continue
+		}
+		if active[user] == nil {
+			active[user] = make(map[string]time.Time)
+		}
+		if last.After(active[user][server]) {
+			active[user][server] = last
+		}
+	}
+
+	// Forget the users without sessions.
+	for user := range r.reported {
+		if _, ok := active[user]; !ok {
+			delete(r.reported, user)
+		}
+	}
+
+	for user, servers := range active {
+		for server, last := range servers {
+			if !last.After(r.reported[user][server]) {
+				delete(servers, server)
+			}
+		}
+		if len(servers) == 0 {
+			delete(active, user)
+		}
+	}
+	return active
+}
+
+// report sends the pending activity, pacing the requests to the hub.
+func (r *activityReporter) report() {
+	pending := r.pending()
+	users := make([]string, 0, len(pending))
+	for user := range pending {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	for _, user := range users {
+		select {
+		case <-time.After(time.Until(r.next)):
+		case <-r.stop:
+			return
+		}
+		r.next = time.Now().Add(r.pace)
+
+		if err := r.jhserver.ReportActivity(user, pending[user]); err != nil {
+			r.logger.Warn(MODULERNAME, fmt.Sprintf("user: %s activity not reported: %s", user, err.Error()))
+			continue
+		}
+		if r.reported[user] == nil {
+			r.reported[user] = make(map[string]time.Time)
+		}
+		for server, last := range pending[user] {
+			r.reported[user][server] = last
+		}
+	}
+}
+
+func (r *activityReporter) Close() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
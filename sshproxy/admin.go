@@ -0,0 +1,274 @@
+package sshproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"jupyterhub-ssh-proxy/audit"
+)
+
+// adminHandler serves the admin API:
+//
+//	GET    /admin/sessions              list sessions, ?user= and ?pod= filter
+//	GET    /admin/sessions/<id>         show a session
+//	DELETE /admin/sessions/<id>         kill a session
+//	DELETE /admin/sessions?user=|pod=   kill the sessions of a user or a pod
+//	POST   /admin/users/<name>/block    refuse logins, ?duration= limits it
+//	                                    and ?kill=true kills the sessions
+//	POST   /admin/users/<name>/unblock  lift a block or lockout
+//	GET    /admin/log-levels            show the log levels
+//	POST   /admin/log-levels?level=     set the default level, or with
+//	                                    ?module= the level of a module
+//	DELETE /admin/log-levels            let a module, with ?module=, or
+//	                                    all modules log at the default
+//
+// who names the caller in the audit stream.
+func (s *SshProxyServer) adminHandler(who string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		s.adminSessions(w, r, who)
+	})
+	mux.HandleFunc("/admin/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		s.adminSession(w, r, who)
+	})
+	mux.HandleFunc("/admin/users/", func(w http.ResponseWriter, r *http.Request) {
+		s.adminUser(w, r, who)
+	})
+	mux.HandleFunc("/admin/log-levels", func(w http.ResponseWriter, r *http.Request) {
+		s.adminLogLevels(w, r, who)
+	})
+	return mux
+}
+
+// ListenAndServeAdmin serves the admin API on a unix socket, only the user
+// of the proxy may connect. It returns at once when no socket is set.
+func (s *SshProxyServer) ListenAndServeAdmin() error {
+	if s.adminServer == nil {
+		return nil
+	}
+
+	path := s.adminServer.Addr
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	s.logger.Info(MODULERNAME, fmt.Sprintf("Admin socket listening on: %s", path))
+	if err := s.adminServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// withToken lets through requests with the admin token as bearer token.
+func withToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid admin token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// KillResult is the answer to a kill request.
+type KillResult struct {
+	Killed []SessionInfo `json:"killed"`
+}
+
+// BlockResult is the answer to a block or unblock request.
+type BlockResult struct {
+	User    string `json:"user"`
+	Blocked bool   `json:"blocked"`
+	// Until is empty when the block lasts until the user is unblocked.
+	Until  *time.Time    `json:"until,omitempty"`
+	Killed []SessionInfo `json:"killed,omitempty"`
+	// Lifted reports whether an unblock lifted a block or lockout.
+	Lifted bool `json:"lifted,omitempty"`
+}
+
+func (s *SshProxyServer) adminSessions(w http.ResponseWriter, r *http.Request, who string) {
+	user := r.URL.Query().Get("user")
+	pod := r.URL.Query().Get("pod")
+
+	var matched []*session
+	for _, sess := range s.sessions.list() {
+		info := sess.info()
+		if (user == "" || info.User == user) && (pod == "" || info.Pod == pod || info.PodIP == pod) {
+			matched = append(matched, sess)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		infos := make([]SessionInfo, 0, len(matched))
+		for _, sess := range matched {
+			infos = append(infos, sess.info())
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case http.MethodDelete:
+		if user == "" && pod == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("kill needs a session ID, a user or a pod"))
+			return
+		}
+		reason := fmt.Sprintf("by %s", who)
+		writeJSON(w, http.StatusOK, s.killSessions(matched, reason))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *SshProxyServer) adminSession(w http.ResponseWriter, r *http.Request, who string) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/sessions/")
+	sess := s.sessions.get(id)
+	if sess == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no session %q", id))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, sess.info())
+	case http.MethodDelete:
+		writeJSON(w, http.StatusOK, s.killSessions([]*session{sess}, fmt.Sprintf("by %s", who)))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// killSessions closes sessions and records who killed them.
+func (s *SshProxyServer) killSessions(sessions []*session, reason string) KillResult {
+	result := KillResult{Killed: make([]SessionInfo, 0, len(sessions))}
+	for _, sess := range sessions {
+		info := sess.info()
+		s.logger.Warn(MODULERNAME, fmt.Sprintf("Killing session %s of %s %s", info.ID, info.User, reason))
+
+		e := sess.event(audit.EventSessionKill)
+		e.Reason = reason
+		s.auditor.Emit(e)
+
+		sess.kill(reason)
+		result.Killed = append(result.Killed, info)
+	}
+	return result
+}
+
+func (s *SshProxyServer) adminUser(w http.ResponseWriter, r *http.Request, who string) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/")
+	if len(parts) != 2 || parts[0] == "" || (parts[1] != "block" && parts[1] != "unblock") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	user := parts[0]
+	// The admin request has no connection, it gets an ID of its own.
+	e := audit.Event{Time: time.Now(), SessionID: "admin-" + newSessionID(), User: user}
+
+	if parts[1] == "unblock" {
+		lifted := s.lockout.unblock(user)
+		s.logger.Info(MODULERNAME, fmt.Sprintf("user: %s unblocked by %s", user, who))
+		e.Type = audit.EventUserUnblock
+		e.Reason = fmt.Sprintf("by %s", who)
+		s.auditor.Emit(e)
+		writeJSON(w, http.StatusOK, BlockResult{User: user, Lifted: lifted})
+		return
+	}
+
+	var d time.Duration
+	if v := r.URL.Query().Get("duration"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration %q", v))
+			return
+		}
+	}
+
+	result := BlockResult{User: user, Blocked: true}
+	if until := s.lockout.block(user, d); !until.IsZero() {
+		result.Until = &until
+	}
+	s.logger.Warn(MODULERNAME, fmt.Sprintf("user: %s blocked by %s", user, who))
+	e.Type = audit.EventUserBlock
+	e.Reason = fmt.Sprintf("by %s", who)
+	e.Duration = d.Seconds()
+	s.auditor.Emit(e)
+
+	if r.URL.Query().Get("kill") == "true" {
+		var sessions []*session
+		for _, sess := range s.sessions.list() {
+			if sess.getUser() == user {
+				sessions = append(sessions, sess)
+			}
+		}
+		result.Killed = s.killSessions(sessions, fmt.Sprintf("blocked by %s", who)).Killed
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *SshProxyServer) adminLogLevels(w http.ResponseWriter, r *http.Request, who string) {
+	if s.logLevels == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("log levels cannot be changed"))
+		return
+	}
+	module := r.URL.Query().Get("module")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		level := r.URL.Query().Get("level")
+		if err := s.logLevels.SetLevel(module, level); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if module == "" {
+			module = "default"
+		}
+		s.logger.Warn(MODULERNAME, fmt.Sprintf("Log level of %s set to %s by %s", module, level, who))
+	case http.MethodDelete:
+		if err := s.logLevels.ResetLevel(module); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if module == "" {
+			module = "all modules"
+		}
+		s.logger.Warn(MODULERNAME, fmt.Sprintf("Log level of %s reset to default by %s", module, who))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.logLevels.Levels())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
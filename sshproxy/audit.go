@@ -0,0 +1,177 @@
+package sshproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"jupyterhub-ssh-proxy/audit"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type execRequest struct {
+	Command string
+}
+
+type subsystemRequest struct {
+	Name string
+}
+
+type exitStatusRequest struct {
+	Status uint32
+}
+
+type exitSignalRequest struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// tcpipForwardRequest is the payload of tcpip-forward and
+// cancel-tcpip-forward, RFC 4254 section 7.1.
+type tcpipForwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+func (p *SshConnProxy) audit(e audit.Event) {
+	if p.auditor != nil {
+		p.auditor.Emit(e)
+	}
+}
+
+// channelTarget is the address a direct-tcpip or forwarded-tcpip channel
+// connects to, both carry it first in their extra data.
+func channelTarget(channelType string, extraData []byte) string {
+	if channelType != "direct-tcpip" && channelType != "forwarded-tcpip" {
+		return ""
+	}
+
+	var payload directTCPIPPayload
+	if err := ssh.Unmarshal(extraData, &payload); err != nil {
+		return ""
+	}
+	return net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
+}
+
+// auditRefused records a channel that could not be opened.
+func (p *SshConnProxy) auditRefused(channelType string, target string, err error) {
+	e := p.session.event(audit.EventChannelOpen)
+	e.ChannelID = p.session.nextChannelID()
+	e.ChannelType = channelType
+	e.Target = target
+	e.Success = audit.Bool(false)
+	e.Reason = err.Error()
+	p.audit(e)
+}
+
+// auditChannel records the opening of a bridged channel, its exec and
+// subsystem requests, its exit and what went through it until it closed.
+// It returns the ID of the channel within the session.
+func (p *SshConnProxy) auditChannel(bridge *channelBridge, channelType string, target string) int {
+	var in, out int64
+	id := p.session.nextChannelID()
+	start := time.Now()
+
+	e := p.session.event(audit.EventChannelOpen)
+	e.ChannelID = id
+	e.ChannelType = channelType
+	e.Target = target
+	e.Success = audit.Bool(true)
+	p.audit(e)
+	p.session.openChannel(channelType)
+
+	bridge.stdin = NewTapReadCloser(bridge.stdin, func(b []byte) {
+		atomic.AddInt64(&in, int64(len(b)))
+		p.session.addBytes(int64(len(b)), 0)
+	})
+	bridge.stdout = NewTapReadCloser(bridge.stdout, func(b []byte) {
+		atomic.AddInt64(&out, int64(len(b)))
+		p.session.addBytes(0, int64(len(b)))
+	})
+	bridge.stderr = NewTapReadCloser(ioutil.NopCloser(bridge.stderr), func(b []byte) {
+		atomic.AddInt64(&out, int64(len(b)))
+		p.session.addBytes(0, int64(len(b)))
+	})
+
+	bridge.onRequest = append(bridge.onRequest, func(req *ssh.Request) {
+		switch req.Type {
+		case "exec":
+			var exec execRequest
+			if err := ssh.Unmarshal(req.Payload, &exec); err == nil {
+				e := p.session.event(audit.EventExec)
+				e.ChannelID = id
+				e.Command = exec.Command
+				p.audit(e)
+			}
+		case "subsystem":
+			var subsystem subsystemRequest
+			if err := ssh.Unmarshal(req.Payload, &subsystem); err == nil {
+				e := p.session.event(audit.EventSubsystem)
+				e.ChannelID = id
+				e.Subsystem = subsystem.Name
+				p.audit(e)
+			}
+		}
+	})
+	bridge.onUpstreamRequest = append(bridge.onUpstreamRequest, func(req *ssh.Request) {
+		switch req.Type {
+		case "exit-status":
+			var status exitStatusRequest
+			if err := ssh.Unmarshal(req.Payload, &status); err == nil {
+				e := p.session.event(audit.EventExit)
+				e.ChannelID = id
+				e.ExitStatus = audit.Int(int(status.Status))
+				p.audit(e)
+			}
+		case "exit-signal":
+			var signal exitSignalRequest
+			if err := ssh.Unmarshal(req.Payload, &signal); err == nil {
+				e := p.session.event(audit.EventExit)
+				e.ChannelID = id
+				e.ExitSignal = signal.Signal
+				p.audit(e)
+			}
+		}
+	})
+	bridge.onClose = append(bridge.onClose, func() {
+		p.closeChannel(id, channelType, start, atomic.LoadInt64(&in), atomic.LoadInt64(&out))
+	})
+
+	return id
+}
+
+func (p *SshConnProxy) closeChannel(id int, channelType string, start time.Time, in int64, out int64) {
+	p.session.closeChannel(channelType)
+
+	e := p.session.event(audit.EventChannelClose)
+	e.ChannelID = id
+	e.ChannelType = channelType
+	e.BytesIn = in
+	e.BytesOut = out
+	e.Duration = time.Since(start).Seconds()
+	p.audit(e)
+}
+
+// auditGlobalRequest records the remote port forwards asked for by the
+// client and whether they were granted.
+func (p *SshConnProxy) auditGlobalRequest(req *ssh.Request, ok bool) {
+	if req.Type != "tcpip-forward" && req.Type != "cancel-tcpip-forward" {
+		return
+	}
+
+	var forward tcpipForwardRequest
+	if err := ssh.Unmarshal(req.Payload, &forward); err != nil {
+		return
+	}
+
+	e := p.session.event(audit.EventForward)
+	e.Request = req.Type
+	e.Target = net.JoinHostPort(forward.Addr, fmt.Sprint(forward.Port))
+	e.Success = audit.Bool(ok)
+	p.audit(e)
+}
@@ -0,0 +1,164 @@
+package sshproxy
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+	"golang.org/x/crypto/ssh"
+)
+
+// channelBridge joins a channel of the ssh client with the matching channel
+// of the user pod. Data and extended data are copied separately, EOF is
+// passed on with CloseWrite, and exit-status / exit-signal are held back
+// until all output of the pod has been delivered to the client.
+type channelBridge struct {
+	client           ssh.Channel
+	clientRequests   <-chan *ssh.Request
+	upstream         ssh.Channel
+	upstreamRequests <-chan *ssh.Request
+
+	// stdout and stderr are copied to the client, stdin to the upstream.
+	// They are the channels themselves or wrappers around them.
+	stdout io.ReadCloser
+	stderr io.Reader
+	stdin  io.ReadCloser
+	// onRequest hooks see every request of the client before it is
+	// forwarded, onUpstreamRequest hooks every request of the upstream,
+	// onClose hooks run once both channels are closed.
+	onRequest         []func(req *ssh.Request)
+	onUpstreamRequest []func(req *ssh.Request)
+	onClose           []func()
+	// check, when set, can refuse a request of the client, it is then
+	// answered with failure and the reason is shown on stderr.
+	check  func(req *ssh.Request) error
+	logger log.Logger
+}
+
+func newChannelBridge(client ssh.Channel, clientRequests <-chan *ssh.Request, upstream ssh.Channel, upstreamRequests <-chan *ssh.Request, logger log.Logger) *channelBridge {
+	return &channelBridge{client: client,
+		clientRequests:   clientRequests,
+		upstream:         upstream,
+		upstreamRequests: upstreamRequests,
+		stdout:           upstream,
+		stderr:           upstream.Stderr(),
+		stdin:            client,
+		logger:           logger}
+}
+
+func isExitRequest(reqType string) bool {
+	return reqType == "exit-status" || reqType == "exit-signal"
+}
+
+func (b *channelBridge) forward(dst ssh.Channel, req *ssh.Request) {
+	ok, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+	if err != nil {
+		b.logger.Warn(MODULERNAME, fmt.Sprintf("Forward request %s get err: %s", req.Type, err.Error()))
+	}
+
+	if req.WantReply {
+		req.Reply(ok, nil)
+	}
+}
+
+func (b *channelBridge) run() {
+	go func() {
+		io.Copy(b.upstream, b.stdin)
+		b.upstream.CloseWrite()
+	}()
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		defer output.Done()
+		io.Copy(b.client, b.stdout)
+	}()
+	go func() {
+		defer output.Done()
+		io.Copy(b.client.Stderr(), b.stderr)
+	}()
+
+	outputDone := make(chan struct{})
+	go func() {
+		output.Wait()
+		close(outputDone)
+	}()
+
+	var (
+		clientRequests   = b.clientRequests
+		upstreamRequests = b.upstreamRequests
+		exitRequests     []*ssh.Request
+		drained          bool
+	)
+
+	for upstreamRequests != nil || !drained {
+		select {
+		case req, ok := <-clientRequests:
+			if !ok {
+				clientRequests = nil
+				b.upstream.Close()
+				continue
+			}
+			b.logger.Debug(MODULERNAME, fmt.Sprintf("Client request: %s", req.Type))
+			if b.check != nil {
+				if err := b.check(req); err != nil {
+					b.refuse(req, err)
+					continue
+				}
+			}
+			b.observe(req)
+			b.forward(b.upstream, req)
+		case req, ok := <-upstreamRequests:
+			if !ok {
+				upstreamRequests = nil
+				continue
+			}
+			b.logger.Debug(MODULERNAME, fmt.Sprintf("Upstream request: %s", req.Type))
+			for _, fn := range b.onUpstreamRequest {
+				fn(req)
+			}
+			if isExitRequest(req.Type) && !drained {
+				exitRequests = append(exitRequests, req)
+				continue
+			}
+			b.forward(b.client, req)
+		case <-outputDone:
+			drained = true
+			outputDone = nil
+
+			b.client.CloseWrite()
+			for _, req := range exitRequests {
+				b.forward(b.client, req)
+			}
+			exitRequests = nil
+		}
+	}
+
+	// Requests the client still sends must not hold up the connection.
+	if clientRequests != nil {
+		go ssh.DiscardRequests(clientRequests)
+	}
+
+	b.stdout.Close()
+	b.upstream.Close()
+	b.client.Close()
+
+	for _, fn := range b.onClose {
+		fn()
+	}
+}
+
+func (b *channelBridge) refuse(req *ssh.Request, err error) {
+	b.logger.Info(MODULERNAME, fmt.Sprintf("Refused request %s: %s", req.Type, err.Error()))
+	fmt.Fprintf(b.client.Stderr(), "%s\r\n", err.Error())
+	if req.WantReply {
+		req.Reply(false, nil)
+	}
+}
+
+func (b *channelBridge) observe(req *ssh.Request) {
+	for _, fn := range b.onRequest {
+		fn(req)
+	}
+}
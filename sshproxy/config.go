@@ -0,0 +1,94 @@
+package sshproxy
+
+import (
+	"time"
+
+	"jupyterhub-ssh-proxy/audit"
+	"jupyterhub-ssh-proxy/recorder"
+	"jupyterhub-ssh-proxy/tracing"
+)
+
+type SshProxyServerConfig struct {
+	GlobalRequests []GlobalRequestRule     `mapstructure:"global_requests"`
+	Recording      recorder.RecorderConfig `mapstructure:"recording"`
+	Audit          audit.AuditConfig       `mapstructure:"audit"`
+	// AuditKeystrokes adds the lines typed in interactive sessions to the
+	// audit stream, lines typed while the pod does not echo are redacted.
+	AuditKeystrokes bool          `mapstructure:"audit_keystrokes"`
+	Shadow          ShadowConfig  `mapstructure:"shadow"`
+	ExecPolicy      []ExecRule    `mapstructure:"exec_policy"`
+	Traffic         TrafficConfig `mapstructure:"traffic"`
+	Lockout         LockoutConfig `mapstructure:"lockout"`
+	// SigningKeyPath is the private key that signs recordings and the
+	// audit log, an ed25519 key is best. The host key is used when empty.
+	SigningKeyPath string     `mapstructure:"signing_key_path"`
+	HTTP           HTTPConfig `mapstructure:"http"`
+	// DrainTimeout is how long SIGTERM waits for open connections to end,
+	// while /readyz reports the server as not ready. Connections still
+	// open then are killed.
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	// AdminSocket is the path of the unix socket the sessions and users
+	// commands talk to, no socket when empty.
+	AdminSocket string `mapstructure:"admin_socket"`
+	// Tracing exports a trace of every login to an OpenTelemetry collector.
+	Tracing tracing.TracingConfig `mapstructure:"tracing"`
+	// Activity reports SSH activity to the hub for its idle culler.
+	Activity ActivityConfig `mapstructure:"activity"`
+}
+
+// HTTPConfig is the optional HTTP listener of the proxy, it serves the
+// Prometheus metrics at /metrics and the /healthz and /readyz probes.
+type HTTPConfig struct {
+	// Listen is the address, e.g. ":9090", no listener when empty.
+	Listen string `mapstructure:"listen"`
+	// AdminToken turns on the admin API under /admin/, requests have to
+	// carry it as bearer token.
+	AdminToken string `mapstructure:"admin_token"`
+}
+
+// ExecRule limits what the users it applies to may run. It applies to the
+// listed hub users and members of the listed hub groups, or to everyone
+// when both are empty. Allow and Deny are regular expressions matched
+// against exec command lines, AllowSubsystems and DenySubsystems against
+// subsystem names. A request matching any deny of the rules that apply is
+// refused, otherwise it has to match an allow of every rule that has one.
+// Allows have to match the whole value, and command lines with shell
+// metacharacters never pass an allow list.
+type ExecRule struct {
+	Users           []string `mapstructure:"users"`
+	Groups          []string `mapstructure:"groups"`
+	Allow           []string `mapstructure:"allow"`
+	Deny            []string `mapstructure:"deny"`
+	AllowSubsystems []string `mapstructure:"allow_subsystems"`
+	DenySubsystems  []string `mapstructure:"deny_subsystems"`
+	// DenyShell refuses interactive shells, a rule with an allow list
+	// refuses them unless AllowShell is set.
+	DenyShell  bool `mapstructure:"deny_shell"`
+	AllowShell bool `mapstructure:"allow_shell"`
+	// AllowForwarding lets a rule with an allow list open port forwards
+	// and ProxyJump connections, which could run any command on the pod.
+	AllowForwarding bool `mapstructure:"allow_forwarding"`
+}
+
+// ShadowConfig lets admins watch the terminal of a running session,
+// read-only, by logging in as "<hub user>:shadow:<session id>".
+type ShadowConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// HubAdmins allows JupyterHub admins, Users and Groups allow other hub
+	// users and groups.
+	HubAdmins bool     `mapstructure:"hub_admins"`
+	Users     []string `mapstructure:"users"`
+	Groups    []string `mapstructure:"groups"`
+	// Notify tells the watched user when someone attaches or detaches.
+	Notify bool `mapstructure:"notify"`
+}
+
+// GlobalRequestRule sets the policy for one connection-level request type.
+// Direction is "client" for requests sent by the ssh client, "upstream" for
+// requests sent by the user pod, or empty for both. Type "*" matches any
+// request type that has no rule of its own.
+type GlobalRequestRule struct {
+	Type      string `mapstructure:"type"`
+	Direction string `mapstructure:"direction"`
+	Policy    string `mapstructure:"policy"`
+}
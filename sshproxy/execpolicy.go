@@ -0,0 +1,225 @@
+package sshproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"jupyterhub-ssh-proxy/audit"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type execRule struct {
+	users           map[string]bool
+	groups          map[string]bool
+	allow           []*regexp.Regexp
+	deny            []*regexp.Regexp
+	allowSubsystems []*regexp.Regexp
+	denySubsystems  []*regexp.Regexp
+	denyShell       bool
+	allowShell      bool
+	allowForwarding bool
+}
+
+// shellMetacharacters let a command line run more than the allowed command
+// once the pod shell parses it.
+const shellMetacharacters = ";|&$`<>\n"
+
+// ExecPolicy decides which shell, exec and subsystem requests of a session
+// are let through.
+type ExecPolicy struct {
+	rules []execRule
+}
+
+// compileAll compiles patterns, anchored ones have to match the whole
+// value instead of a part of it.
+func compileAll(patterns []string, anchored bool) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if anchored {
+			pattern = "^(?:" + pattern + ")$"
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("exec policy: %s", err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func NewExecPolicy(rules []ExecRule) (*ExecPolicy, error) {
+	p := &ExecPolicy{}
+
+	for _, r := range rules {
+		rule := execRule{users: make(map[string]bool),
+			groups:          make(map[string]bool),
+			denyShell:       r.DenyShell,
+			allowShell:      r.AllowShell,
+			allowForwarding: r.AllowForwarding}
+		for _, user := range r.Users {
+			rule.users[user] = true
+		}
+		for _, group := range r.Groups {
+			rule.groups[group] = true
+		}
+
+		var err error
+		if rule.allow, err = compileAll(r.Allow, true); err != nil {
+			return nil, err
+		}
+		if rule.deny, err = compileAll(r.Deny, false); err != nil {
+			return nil, err
+		}
+		if rule.allowSubsystems, err = compileAll(r.AllowSubsystems, true); err != nil {
+			return nil, err
+		}
+		if rule.denySubsystems, err = compileAll(r.DenySubsystems, false); err != nil {
+			return nil, err
+		}
+
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, nil
+}
+
+// Enabled reports whether the policy has any rule.
+func (p *ExecPolicy) Enabled() bool {
+	return len(p.rules) > 0
+}
+
+func (r execRule) appliesTo(username string, groups []string) bool {
+	if len(r.users) == 0 && len(r.groups) == 0 {
+		return true
+	}
+	if r.users[username] {
+		return true
+	}
+	for _, group := range groups {
+		if r.groups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(res []*regexp.Regexp, s string) *regexp.Regexp {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return re
+		}
+	}
+	return nil
+}
+
+// restricted reports whether the rule only lets listed commands or
+// subsystems through.
+func (r execRule) restricted() bool {
+	return len(r.allow) > 0 || len(r.allowSubsystems) > 0
+}
+
+// Check decides on a shell, exec or subsystem request of a user, or on a
+// direct-tcpip channel, which port forwards and ProxyJump open. value is
+// the command line, the subsystem name or the target address. It returns
+// nil when the request is allowed, or the reason it is not.
+func (p *ExecPolicy) Check(username string, groups []string, reqType string, value string) error {
+	for _, rule := range p.rules {
+		if !rule.appliesTo(username, groups) {
+			continue
+		}
+
+		var allow, deny []*regexp.Regexp
+		switch reqType {
+		case "shell":
+			// A shell runs any command, an allow list has to let it in.
+			if rule.denyShell || (rule.restricted() && !rule.allowShell) {
+				return fmt.Errorf("interactive shells are not allowed")
+			}
+			continue
+		case "direct-tcpip":
+			// A forward to the pod sshd runs any command.
+			if rule.restricted() && !rule.allowForwarding {
+				return fmt.Errorf("port forwarding to %s is not allowed", value)
+			}
+			continue
+		case "exec":
+			allow, deny = rule.allow, rule.deny
+			if len(allow) > 0 && strings.ContainsAny(value, shellMetacharacters) {
+				return fmt.Errorf("%s %q has shell metacharacters", reqType, value)
+			}
+		case "subsystem":
+			allow, deny = rule.allowSubsystems, rule.denySubsystems
+		default:
+			continue
+		}
+
+		if re := matchAny(deny, value); re != nil {
+			return fmt.Errorf("%s %q is denied by %q", reqType, value, re.String())
+		}
+		if len(allow) > 0 && matchAny(allow, value) == nil {
+			return fmt.Errorf("%s %q is not allowed", reqType, value)
+		}
+	}
+
+	return nil
+}
+
+// checkRequest asks checkFn about the shell, exec and subsystem requests of
+// a session channel, and audits every decision.
+func (p *SshConnProxy) checkRequest(serverConn *ssh.ServerConn, channelID int) func(req *ssh.Request) error {
+	return func(req *ssh.Request) error {
+		e := p.session.event(audit.EventPolicy)
+		e.ChannelID = channelID
+		e.Request = req.Type
+
+		var err error
+		switch req.Type {
+		case "shell":
+			err = p.checkFn(serverConn, req.Type, "")
+		case "exec":
+			var exec execRequest
+			if err = ssh.Unmarshal(req.Payload, &exec); err == nil {
+				e.Command = exec.Command
+				err = p.checkFn(serverConn, req.Type, exec.Command)
+			}
+		case "subsystem":
+			var subsystem subsystemRequest
+			if err = ssh.Unmarshal(req.Payload, &subsystem); err == nil {
+				e.Subsystem = subsystem.Name
+				err = p.checkFn(serverConn, req.Type, subsystem.Name)
+			}
+		default:
+			return nil
+		}
+
+		e.Success = audit.Bool(err == nil)
+		if err != nil {
+			e.Reason = err.Error()
+		}
+		p.audit(e)
+
+		return err
+	}
+}
+
+// checkChannel asks checkFn about a direct-tcpip channel before it is
+// forwarded or jumped to a pod, and audits a refusal.
+func (p *SshConnProxy) checkChannel(serverConn *ssh.ServerConn, newChannel ssh.NewChannel) error {
+	if p.checkFn == nil || newChannel.ChannelType() != "direct-tcpip" {
+		return nil
+	}
+
+	target := channelTarget(newChannel.ChannelType(), newChannel.ExtraData())
+	err := p.checkFn(serverConn, newChannel.ChannelType(), target)
+	if err != nil {
+		e := p.session.event(audit.EventPolicy)
+		e.Request = newChannel.ChannelType()
+		e.Target = target
+		e.Success = audit.Bool(false)
+		e.Reason = err.Error()
+		p.audit(e)
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package sshproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+	"golang.org/x/crypto/ssh"
+)
+
+func restrictedPolicy(t *testing.T) *ExecPolicy {
+	p, err := NewExecPolicy([]ExecRule{{Groups: []string{"restricted"},
+		Allow: []string{"rsync --server .*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestExecPolicyRestrictedRefusesShell(t *testing.T) {
+	p := restrictedPolicy(t)
+
+	if err := p.Check("alice", []string{"restricted"}, "shell", ""); err == nil {
+		t.Error("shell allowed under a rule with an allow list")
+	}
+	if err := p.Check("alice", []string{"restricted"}, "exec", "rsync --server -e . /data"); err != nil {
+		t.Errorf("allowed command refused: %s", err)
+	}
+	if err := p.Check("bob", nil, "shell", ""); err != nil {
+		t.Errorf("shell refused for a user without a rule: %s", err)
+	}
+
+	p, err := NewExecPolicy([]ExecRule{{Groups: []string{"restricted"},
+		Allow: []string{"rsync --server .*"}, AllowShell: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check("alice", []string{"restricted"}, "shell", ""); err != nil {
+		t.Errorf("shell refused with allow_shell: %s", err)
+	}
+}
+
+func TestExecPolicyRefusesJumpAsFirstChannel(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := restrictedPolicy(t)
+	requestPolicy, _ := NewGlobalRequestPolicy(nil)
+
+	// The pod sshd a jump would be relayed to.
+	pod, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer pod.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		if c, err := pod.Accept(); err == nil {
+			dialed <- struct{}{}
+			c.Close()
+		}
+	}()
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conf := &ssh.ServerConfig{NoClientAuth: true}
+		conf.AddHostKey(hostKey)
+		p := &SshConnProxy{Conn: c,
+			// The user has to pick a server, so the jump is the first
+			// channel while there is no upstream yet.
+			callbackFn: func(c ssh.ConnMetadata) (*ssh.Client, <-chan *ssh.Request, error) {
+				return nil, nil, nil
+			},
+			jumpFn: func(c ssh.ConnMetadata, host string, port uint32) string {
+				return pod.Addr().String()
+			},
+			checkFn: func(c ssh.ConnMetadata, reqType string, value string) error {
+				return policy.Check("alice", []string{"restricted"}, reqType, value)
+			},
+			requestPolicy: requestPolicy,
+			session:       newSession("test"),
+			logger:        log.NewNopLogger()}
+		p.proxy(conf)
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{User: "alice",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if conn, err := client.Dial("tcp", "jupyter-alice:22"); err == nil {
+		conn.Close()
+		t.Fatal("jump opened under a rule with an allow list")
+	}
+	select {
+	case <-dialed:
+		t.Fatal("jump reached the pod sshd")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,134 @@
+package sshproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"jupyterhub-ssh-proxy/metrics"
+)
+
+// readyTimeout bounds the hub check of a readiness probe.
+const readyTimeout = 5 * time.Second
+
+// newHTTPServer returns nil when no listen address is set.
+func (s *SshProxyServer) newHTTPServer(c HTTPConfig) *http.Server {
+	if c.Listen == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	if c.AdminToken != "" {
+		mux.Handle("/admin/", withToken(c.AdminToken, s.adminHandler("admin api")))
+	}
+
+	return &http.Server{Addr: c.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second}
+}
+
+// ListenAndServeHTTP serves the HTTP endpoints until the server is closed,
+// it returns at once when there is no HTTP listener.
+func (s *SshProxyServer) ListenAndServeHTTP() error {
+	if s.httpServer == nil {
+		return nil
+	}
+
+	s.logger.Info(MODULERNAME, fmt.Sprintf("HTTP listening on: %s", s.httpServer.Addr))
+	if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// healthz reports whether the accept loop runs.
+func (s *SshProxyServer) healthz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.accepting) == 0 {
+		http.Error(w, "accept loop is not running", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether the proxy can take logins: the hub answers with
+// the admin token, the host key is loaded and the server is not draining.
+func (s *SshProxyServer) readyz(w http.ResponseWriter, r *http.Request) {
+	var failed []string
+	report := func(check string, err error) {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", check, err.Error()))
+		}
+	}
+
+	if s.host_key == nil {
+		report("host_key", fmt.Errorf("not loaded"))
+	}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		report("draining", fmt.Errorf("the server is shutting down"))
+	}
+
+	hub := make(chan error, 1)
+	go func() {
+		hub <- s.jhserver.Check()
+	}()
+	select {
+	case err := <-hub:
+		report("hub", err)
+	case <-time.After(readyTimeout):
+		report("hub", fmt.Errorf("no answer within %s", readyTimeout))
+	}
+
+	if len(failed) > 0 {
+		s.logger.Warn(MODULERNAME, fmt.Sprintf("Not ready: %s", strings.Join(failed, ", ")))
+		http.Error(w, strings.Join(failed, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// drainKillWait is how long Drain waits for the sessions it killed to end,
+// so their end is in the audit log before it is closed.
+const drainKillWait = 5 * time.Second
+
+// Drain marks the server as not ready and waits up to timeout for the open
+// connections to end. New connections are still accepted meanwhile, until
+// the load balancer notices. Sessions still open after timeout are killed.
+func (s *SshProxyServer) Drain(timeout time.Duration) {
+	atomic.StoreInt32(&s.draining, 1)
+
+	deadline := time.Now().Add(timeout)
+	last := -1
+	for {
+		open := s.sessions.count()
+		if open == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			s.logger.Warn(MODULERNAME, fmt.Sprintf("Drain timeout, killing %d connections", open))
+			s.killSessions(s.sessions.list(), "proxy shutting down")
+			s.waitSessions(drainKillWait)
+			return
+		}
+		if open != last {
+			s.logger.Info(MODULERNAME, fmt.Sprintf("Draining, %d connections open", open))
+			last = open
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// waitSessions waits up to timeout for all sessions to end.
+func (s *SshProxyServer) waitSessions(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for s.sessions.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if open := s.sessions.count(); open > 0 {
+		s.logger.Warn(MODULERNAME, fmt.Sprintf("Closing with %d connections open", open))
+	}
+}
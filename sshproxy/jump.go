@@ -0,0 +1,96 @@
+package sshproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"jupyterhub-ssh-proxy/audit"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// directTCPIPPayload is the extra data of a direct-tcpip channel open,
+// RFC 4254 section 7.2.
+type directTCPIPPayload struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// jump connects a direct-tcpip channel straight to the sshd of a user pod,
+// so the proxy acts as a ProxyJump bastion and only ever relays the
+// encrypted end-to-end session between the client and the pod.
+func (p *SshConnProxy) jump(newChannel ssh.NewChannel, addr string) {
+	target := channelTarget(newChannel.ChannelType(), newChannel.ExtraData())
+	dialStart := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	upstreamDialSeconds.With("jump").Observe(time.Since(dialStart).Seconds())
+	if err != nil {
+		upstreamDialFailures.With("jump").Inc()
+		p.logger.Warn(MODULERNAME, fmt.Sprintf("Jump to %s get err: %s", addr, err.Error()))
+		p.auditRefused(newChannel.ChannelType(), target, err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		p.logger.Error(MODULERNAME, fmt.Sprintf("Could not accept jump channel: %s", err.Error()))
+		conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	p.logger.Info(MODULERNAME, fmt.Sprintf("Jump channel connected to %s", addr))
+
+	id := p.session.nextChannelID()
+	start := time.Now()
+	e := p.session.event(audit.EventChannelOpen)
+	e.ChannelID = id
+	e.ChannelType = newChannel.ChannelType()
+	e.Target = target
+	e.PodIP, _, _ = net.SplitHostPort(addr)
+	e.Success = audit.Bool(true)
+	p.audit(e)
+	p.session.openChannel(newChannel.ChannelType())
+
+	in := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(conn, NewTapReadCloser(channel, func(b []byte) {
+			p.session.addBytes(int64(len(b)), 0)
+		}))
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		in <- n
+	}()
+
+	out, _ := io.Copy(channel, NewTapReadCloser(conn, func(b []byte) {
+		p.session.addBytes(0, int64(len(b)))
+	}))
+	channel.CloseWrite()
+	channel.Close()
+	conn.Close()
+
+	p.closeChannel(id, newChannel.ChannelType(), start, <-in, out)
+}
+
+// jumpTarget returns the pod address a direct-tcpip channel should be
+// connected to, or an empty string when it should go through the upstream
+// connection as a normal port forward.
+func (p *SshConnProxy) jumpTarget(c ssh.ConnMetadata, newChannel ssh.NewChannel) string {
+	if p.jumpFn == nil || newChannel.ChannelType() != "direct-tcpip" {
+		return ""
+	}
+
+	var payload directTCPIPPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		return ""
+	}
+
+	return p.jumpFn(c, payload.Host, payload.Port)
+}
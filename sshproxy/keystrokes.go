@@ -0,0 +1,214 @@
+package sshproxy
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// RedactedInput replaces a line typed while the terminal did not echo.
+const RedactedInput = "[REDACTED]"
+
+// echoWait is how long a finished line waits for its echo.
+const echoWait = 300 * time.Millisecond
+
+var secretPrompt = regexp.MustCompile(`(?i)(password|passphrase|passcode|pin|token|secret|otp)[^:\n]*:\s*$`)
+
+// keystrokeAuditor rebuilds the lines typed in an interactive session and
+// reports each finished line. It watches whether the pod echoes what is
+// typed: a line typed while echo is off, e.g. at a password or sudo prompt,
+// is reported as RedactedInput and its content is never kept around after
+// the line is finished.
+type keystrokeAuditor struct {
+	mu sync.Mutex
+
+	line []byte
+	// Typed characters whose echo has not been seen yet.
+	awaiting []byte
+	secret   bool
+	escape   bool
+	// Text of the current output line, to spot password prompts.
+	prompt []byte
+
+	finishing *time.Timer
+	report    func(line string, redacted bool)
+}
+
+func newKeystrokeAuditor(report func(line string, redacted bool)) *keystrokeAuditor {
+	return &keystrokeAuditor{report: report}
+}
+
+// Input takes what the client sends to the pod.
+func (k *keystrokeAuditor) Input(p []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, b := range p {
+		if k.escape {
+			// CSI and SS3 sequences end with a byte in 0x40-0x7e.
+			if b >= 0x40 && b <= 0x7e && b != '[' && b != 'O' {
+				k.escape = false
+			}
+			continue
+		}
+
+		switch {
+		case b == 0x1b:
+			k.escape = true
+		case b == '\r' || b == '\n':
+			k.finishLine()
+		case b == 0x7f || b == '\b':
+			if len(k.line) > 0 {
+				k.line = k.line[:len(k.line)-1]
+			}
+			if len(k.awaiting) > 0 {
+				k.awaiting = k.awaiting[:len(k.awaiting)-1]
+			}
+		case b == 0x03 || b == 0x15:
+			// ^C and ^U throw the line away.
+			k.resetLine()
+		case b == '\t':
+			k.line = append(k.line, b)
+		case b >= 0x20:
+			if len(k.line) == 0 && secretPrompt.Match(k.prompt) {
+				k.secret = true
+			}
+			k.line = append(k.line, b)
+			k.awaiting = append(k.awaiting, b)
+		}
+	}
+}
+
+// Output takes what the pod sends to the client.
+func (k *keystrokeAuditor) Output(p []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.trackPrompt(p)
+
+	if len(k.awaiting) == 0 {
+		return
+	}
+
+	visible := visibleText(p)
+	if len(visible) == 0 {
+		return
+	}
+
+	n := len(visible)
+	if n > len(k.awaiting) {
+		n = len(k.awaiting)
+	}
+	if bytes.Equal(visible[:n], k.awaiting[:n]) {
+		k.awaiting = k.awaiting[n:]
+	} else {
+		// The pod answered with something else than what was typed.
+		k.secret = true
+		k.awaiting = nil
+	}
+
+	if k.finishing != nil && (k.secret || len(k.awaiting) == 0) {
+		k.finishing.Stop()
+		k.finishing = nil
+		k.flush()
+	}
+}
+
+// Close reports a line that is still waiting for its echo.
+func (k *keystrokeAuditor) Close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.finishing != nil {
+		k.finishing.Stop()
+		k.finishing = nil
+		if len(k.awaiting) > 0 {
+			k.secret = true
+		}
+		k.flush()
+	}
+}
+
+func (k *keystrokeAuditor) finishLine() {
+	if k.finishing != nil {
+		// The previous line still waits, it never saw its echo.
+		k.finishing.Stop()
+		k.finishing = nil
+		k.secret = true
+		k.flush()
+	}
+
+	if len(k.awaiting) == 0 || k.secret {
+		k.flush()
+		return
+	}
+
+	k.finishing = time.AfterFunc(echoWait, func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+
+		if k.finishing == nil {
+			return
+		}
+		k.finishing = nil
+		k.secret = true
+		k.flush()
+	})
+}
+
+func (k *keystrokeAuditor) flush() {
+	if k.secret {
+		k.report(RedactedInput, true)
+	} else if len(k.line) > 0 {
+		k.report(string(k.line), false)
+	}
+	k.resetLine()
+}
+
+func (k *keystrokeAuditor) resetLine() {
+	for i := range k.line {
+		k.line[i] = 0
+	}
+	k.line = k.line[:0]
+	k.awaiting = nil
+	k.secret = false
+}
+
+func (k *keystrokeAuditor) trackPrompt(p []byte) {
+	if i := bytes.LastIndexAny(p, "\r\n"); i >= 0 {
+		k.prompt = k.prompt[:0]
+		p = p[i+1:]
+	}
+	k.prompt = append(k.prompt, visibleText(p)...)
+	if len(k.prompt) > 256 {
+		k.prompt = k.prompt[len(k.prompt)-256:]
+	}
+}
+
+var eraseChar = []byte("\b \b")
+
+// visibleText drops terminal escape sequences, control characters and the
+// erase of a character after backspace.
+func visibleText(p []byte) []byte {
+	p = bytes.Replace(p, eraseChar, nil, -1)
+
+	visible := make([]byte, 0, len(p))
+	escape := false
+	for _, b := range p {
+		if escape {
+			if b >= 0x40 && b <= 0x7e && b != '[' && b != ']' && b != 'O' {
+				escape = false
+			}
+			continue
+		}
+
+		switch {
+		case b == 0x1b:
+			escape = true
+		case b >= 0x20 && b != 0x7f:
+			visible = append(visible, b)
+		}
+	}
+	return visible
+}
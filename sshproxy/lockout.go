@@ -0,0 +1,190 @@
+package sshproxy
+
+import (
+	"sync"
+	"time"
+)
+
+type LockoutConfig struct {
+	// MaxFailures failed password logins of a user within Window lock the
+	// user out for Duration, 0 never locks anyone out.
+	MaxFailures int           `mapstructure:"max_failures"`
+	Window      time.Duration `mapstructure:"window"`
+	Duration    time.Duration `mapstructure:"duration"`
+}
+
+// maxLockoutUsers caps the users with failed logins or a lockout that are
+// tracked. Login names are unchecked before authentication, once the cap is
+// reached the failures of untracked users share one overflow count, and
+// when it locks, every untracked user is locked out. Tracked users are
+// never forgotten early, that would lift their lockout.
+const maxLockoutUsers = 10000
+
+// lockout counts failed logins per hub user. Only password and token logins
+// count, clients routinely offer several keys before the right one.
+type lockout struct {
+	mu          sync.Mutex
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	failures    map[string][]time.Time
+	locked      map[string]time.Time
+	// Failures and lockout of the users not tracked once the cap is
+	// reached.
+	overflow       []time.Time
+	overflowLocked time.Time
+	// Users blocked by an admin, until the time or until unblocked when
+	// it is zero.
+	blocked map[string]time.Time
+}
+
+func newLockout(c LockoutConfig) *lockout {
+	l := &lockout{maxFailures: c.MaxFailures,
+		window:   c.Window,
+		duration: c.Duration,
+		failures: make(map[string][]time.Time),
+		locked:   make(map[string]time.Time),
+		blocked:  make(map[string]time.Time)}
+
+	if l.window <= 0 {
+		l.window = 10 * time.Minute
+	}
+	if l.duration <= 0 {
+		l.duration = 15 * time.Minute
+	}
+	return l
+}
+
+// isLocked reports whether a user is locked out.
+func (l *lockout) isLocked(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.locked[username]
+	if !ok {
+		_, tracked := l.failures[username]
+		return !tracked && time.Now().Before(l.overflowLocked)
+	}
+	if time.Now().After(until) {
+		delete(l.locked, username)
+		return false
+	}
+	return true
+}
+
+// fail counts a failed login and reports whether it locked the user out.
+func (l *lockout) fail(username string) bool {
+	if l.maxFailures <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	_, tracked := l.failures[username]
+	if !tracked && len(l.failures) >= maxLockoutUsers {
+		l.overflow = append(l.overflow, now)
+		if len(l.overflow) < l.maxFailures {
+			return false
+		}
+		l.overflow = nil
+		l.overflowLocked = now.Add(l.duration)
+		return true
+	}
+
+	recent := l.failures[username][:0]
+	for _, t := range l.failures[username] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) < l.maxFailures {
+		l.failures[username] = recent
+		return false
+	}
+
+	delete(l.failures, username)
+	if _, ok := l.locked[username]; !ok && len(l.locked) >= maxLockoutUsers {
+		l.overflowLocked = now.Add(l.duration)
+		return true
+	}
+	l.locked[username] = now.Add(l.duration)
+	return true
+}
+
+// prune drops the failures older than the window and the lockouts that
+// ended.
+func (l *lockout) prune(now time.Time) {
+	for username, times := range l.failures {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= l.window {
+			delete(l.failures, username)
+		}
+	}
+	for username, until := range l.locked {
+		if now.After(until) {
+			delete(l.locked, username)
+		}
+	}
+
+	recent := l.overflow[:0]
+	for _, t := range l.overflow {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	l.overflow = recent
+}
+
+// succeed forgets the failed logins of a user.
+func (l *lockout) succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, username)
+}
+
+// block refuses every login of a user for d, or until unblocked when d is 0.
+func (l *lockout) block(username string, d time.Duration) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	l.blocked[username] = until
+	return until
+}
+
+// unblock lifts a block or lockout of a user and reports whether there was
+// one.
+func (l *lockout) unblock(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, blocked := l.blocked[username]
+	_, locked := l.locked[username]
+	delete(l.blocked, username)
+	delete(l.locked, username)
+	delete(l.failures, username)
+	return blocked || locked
+}
+
+func (l *lockout) isBlocked(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.blocked[username]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		delete(l.blocked, username)
+		return false
+	}
+	return true
+}
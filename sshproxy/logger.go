@@ -0,0 +1,48 @@
+package sshproxy
+
+import (
+	"fmt"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+)
+
+// sessionLogger prefixes every line it logs with the session ID, the user
+// and the remote address of a connection, so the lines of one connection
+// can be told apart, e.g. "[3fa2c1d0 alice 10.0.0.7:52114] Connection closed.".
+type sessionLogger struct {
+	session *session
+	logger  log.Logger
+}
+
+func newSessionLogger(sess *session, logger log.Logger) log.Logger {
+	return &sessionLogger{session: sess, logger: logger}
+}
+
+func (l *sessionLogger) prefix(data interface{}) string {
+	user := l.session.getUser()
+	if user == "" {
+		// Before the banner, the user is not known yet.
+		user = "-"
+	}
+	return fmt.Sprintf("[%s %s %s] %v", l.session.id, user, l.session.remoteAddr, data)
+}
+
+func (l *sessionLogger) Debug(module string, data interface{}) {
+	l.logger.Debug(module, l.prefix(data))
+}
+
+func (l *sessionLogger) Info(module string, data interface{}) {
+	l.logger.Info(module, l.prefix(data))
+}
+
+func (l *sessionLogger) Warn(module string, data interface{}) {
+	l.logger.Warn(module, l.prefix(data))
+}
+
+func (l *sessionLogger) Error(module string, data interface{}) {
+	l.logger.Error(module, l.prefix(data))
+}
+
+func (l *sessionLogger) Panic(module string, data interface{}) {
+	l.logger.Panic(module, l.prefix(data))
+}
@@ -0,0 +1,32 @@
+package sshproxy
+
+import (
+	"jupyterhub-ssh-proxy/metrics"
+)
+
+var (
+	connectionsActive = metrics.NewGauge(metrics.Default, "jupyterhub_ssh_proxy_connections_active",
+		"SSH connections open to the proxy.")
+	channelsActive = metrics.NewGaugeVec(metrics.Default, "jupyterhub_ssh_proxy_channels_active",
+		"Channels open, by channel type.", "type")
+	authAttempts = metrics.NewCounterVec(metrics.Default, "jupyterhub_ssh_proxy_auth_attempts_total",
+		"Authentication attempts, by method and result.", "method", "result")
+	upstreamDialSeconds = metrics.NewHistogramVec(metrics.Default, "jupyterhub_ssh_proxy_upstream_dial_duration_seconds",
+		"Time to connect to user pods, by kind: ssh for proxied sessions, jump for ProxyJump channels.", nil, "kind")
+	upstreamDialFailures = metrics.NewCounterVec(metrics.Default, "jupyterhub_ssh_proxy_upstream_dial_failures_total",
+		"Failed connections to user pods, by kind.", "kind")
+	bytesRelayed = metrics.NewCounterVec(metrics.Default, "jupyterhub_ssh_proxy_bytes_relayed_total",
+		"Bytes relayed, by direction: in from clients, out to clients.", "direction")
+	lockouts = metrics.NewCounter(metrics.Default, "jupyterhub_ssh_proxy_lockouts_total",
+		"Users locked out after failed logins.")
+
+	bytesRelayedIn  = bytesRelayed.With("in")
+	bytesRelayedOut = bytesRelayed.With("out")
+)
+
+func authResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,276 @@
+package sshproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"jupyterhub-ssh-proxy/jupyterhubserver"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errNoUpstream = errors.New("upstream connection is not open yet")
+
+// upstreamConn forwards connection-level requests to the upstream
+// connection once it is open. Requests arriving before that are refused.
+type upstreamConn struct {
+	mu   sync.Mutex
+	conn ssh.Conn
+}
+
+func (u *upstreamConn) set(conn ssh.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conn = conn
+}
+
+func (u *upstreamConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	u.mu.Lock()
+	conn := u.conn
+	u.mu.Unlock()
+
+	if conn == nil {
+		return false, nil, errNoUpstream
+	}
+	return conn.SendRequest(name, wantReply, payload)
+}
+
+// pendingChannel is the first channel of a connection whose upstream was
+// chosen only after the channel was opened. Either newChannel is set and
+// the channel is still to be opened upstream, or it is an accepted session
+// whose setup requests were answered locally and have to be replayed.
+type pendingChannel struct {
+	newChannel ssh.NewChannel
+
+	channel  ssh.Channel
+	requests <-chan *ssh.Request
+	replay   []*ssh.Request
+	start    *ssh.Request
+}
+
+// pickUpstream waits for the first channel of a connection whose user has to
+// choose a server. An interactive shell gets a menu on the terminal, any
+// other channel connects to the default server.
+func (p *SshConnProxy) pickUpstream(serverConn *ssh.ServerConn, chans <-chan ssh.NewChannel) (*ssh.Client, <-chan *ssh.Request, *pendingChannel, error) {
+	var newChannel ssh.NewChannel
+	for newChannel == nil {
+		next, ok := <-chans
+		if !ok {
+			return nil, nil, nil, io.EOF
+		}
+
+		// ProxyJump needs no upstream connection.
+		if addr := p.jumpTarget(serverConn, next); addr != "" {
+			if err := p.checkChannel(serverConn, next); err != nil {
+				rejectChannel(next, err)
+				continue
+			}
+			go p.jump(next, addr)
+			continue
+		}
+		newChannel = next
+	}
+
+	if newChannel.ChannelType() != "session" {
+		client, reqs, err := p.selectFn(serverConn, nil)
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			return nil, nil, nil, err
+		}
+		return client, reqs, &pendingChannel{newChannel: newChannel}, nil
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pending := &pendingChannel{channel: channel, requests: requests}
+	pty := false
+	for req := range requests {
+		switch req.Type {
+		case "shell", "exec", "subsystem":
+			pending.start = req
+		case "pty-req":
+			pty = true
+		}
+
+		if pending.start != nil {
+			break
+		}
+
+		pending.replay = append(pending.replay, req)
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+	}
+
+	if pending.start == nil {
+		channel.Close()
+		return nil, nil, nil, io.EOF
+	}
+
+	// Clients wait for the shell reply before they send what is typed, so
+	// the shell is accepted before the menu is shown.
+	var term io.ReadWriter
+	if pty && pending.start.Type == "shell" {
+		term = channel
+		if pending.start.WantReply {
+			pending.start.Reply(true, nil)
+			pending.start.WantReply = false
+		}
+	}
+
+	client, reqs, err := p.selectFn(serverConn, term)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "%s\r\n", err.Error())
+		if pending.start.WantReply {
+			pending.start.Reply(false, nil)
+		}
+		channel.Close()
+		return nil, nil, nil, err
+	}
+
+	return client, reqs, pending, nil
+}
+
+// startPending opens the upstream side of the pending channel and replays
+// the requests that were answered while the user was choosing.
+func (p *SshConnProxy) startPending(serverConn *ssh.ServerConn, clientConn *ssh.Client, pending *pendingChannel) {
+	if pending.newChannel != nil {
+		p.handleChannel(serverConn, clientConn, pending.newChannel)
+		return
+	}
+
+	channel2, requests2, err := clientConn.OpenChannel("session", nil)
+	if err != nil {
+		p.logger.Warn(MODULERNAME, fmt.Sprintf("Could not open upstream session channel: %s", err.Error()))
+		fmt.Fprintf(pending.channel.Stderr(), "%s\r\n", err.Error())
+		if pending.start.WantReply {
+			pending.start.Reply(false, nil)
+		}
+		pending.channel.Close()
+		return
+	}
+
+	bridge := p.newBridge(serverConn, "session", "", pending.channel, pending.requests, channel2, requests2)
+	if bridge.check != nil {
+		if err := bridge.check(pending.start); err != nil {
+			bridge.refuse(pending.start, err)
+			pending.channel.Close()
+			channel2.Close()
+			return
+		}
+	}
+
+	for _, req := range pending.replay {
+		bridge.observe(req)
+		if _, err := channel2.SendRequest(req.Type, req.WantReply, req.Payload); err != nil {
+			p.logger.Warn(MODULERNAME, fmt.Sprintf("Replay request %s get err: %s", req.Type, err.Error()))
+		}
+	}
+
+	ok, err := channel2.SendRequest(pending.start.Type, true, pending.start.Payload)
+	if err != nil {
+		p.logger.Warn(MODULERNAME, fmt.Sprintf("Forward request %s get err: %s", pending.start.Type, err.Error()))
+	}
+	if pending.start.WantReply {
+		pending.start.Reply(ok, nil)
+	} else if !ok {
+		fmt.Fprintf(pending.channel.Stderr(), "upstream refused %s\r\n", pending.start.Type)
+		pending.channel.Close()
+		channel2.Close()
+		return
+	}
+
+	go bridge.run()
+}
+
+func serverStatus(server jupyterhubserver.UserServer) string {
+	switch {
+	case server.Running():
+		return "running"
+	case !server.Started.IsZero():
+		return "starting"
+	default:
+		return "stopped"
+	}
+}
+
+func serverLabel(server jupyterhubserver.UserServer) string {
+	if server.Name == "" {
+		return "(default)"
+	}
+	return server.Name
+}
+
+// serverMenu lists the servers of a user on the terminal and reads the
+// number of the one to connect to.
+func serverMenu(term io.ReadWriter, servers []jupyterhubserver.UserServer) (jupyterhubserver.UserServer, error) {
+	var menu bytes.Buffer
+	w := tabwriter.NewWriter(&menu, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "You have %d servers:\n", len(servers))
+	for i, server := range servers {
+		started := "-"
+		if !server.Started.IsZero() {
+			started = server.Started.Local().Format("2006-01-02 15:04")
+		}
+		profile := server.Profile
+		if profile == "" {
+			profile = "-"
+		}
+		fmt.Fprintf(w, "  %d)\t%s\tprofile: %s\tstarted: %s\t%s\n", i+1, serverLabel(server), profile, started, serverStatus(server))
+	}
+	w.Flush()
+	term.Write(bytes.Replace(menu.Bytes(), []byte("\n"), []byte("\r\n"), -1))
+
+	for {
+		fmt.Fprintf(term, "Select a server [1-%d]: ", len(servers))
+		line, err := readLine(term)
+		if err != nil {
+			return jupyterhubserver.UserServer{}, err
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(line))
+		if err == nil && n >= 1 && n <= len(servers) {
+			return servers[n-1], nil
+		}
+		fmt.Fprintf(term, "Invalid choice %q\r\n", line)
+	}
+}
+
+// readLine reads a line from a terminal in raw mode, echoing what is typed.
+func readLine(term io.ReadWriter) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := term.Read(b); err != nil {
+			return "", err
+		}
+
+		switch b[0] {
+		case '\r', '\n':
+			term.Write([]byte("\r\n"))
+			return string(line), nil
+		case 0x03, 0x04:
+			term.Write([]byte("\r\n"))
+			return "", errors.New("selection aborted")
+		case 0x7f, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				term.Write([]byte("\b \b"))
+			}
+		default:
+			if b[0] >= 0x20 && b[0] < 0x7f {
+				line = append(line, b[0])
+				term.Write(b)
+			}
+		}
+	}
+}
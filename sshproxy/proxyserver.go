@@ -3,9 +3,18 @@ package sshproxy
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"jupyterhub-ssh-proxy/audit"
 	"jupyterhub-ssh-proxy/jupyterhubserver"
+	"jupyterhub-ssh-proxy/loglevel"
+	"jupyterhub-ssh-proxy/recorder"
+	"jupyterhub-ssh-proxy/tracing"
 
 	log "github.com/lylelaii/golang_utils/logger/v1"
 	"golang.org/x/crypto/ssh"
@@ -14,15 +23,87 @@ import (
 const MODULERNAME = "ssh-proxy"
 
 type SshProxyServer struct {
-	addr     string
-	host_key ssh.Signer
-	listener net.Listener
-	jhserver *jupyterhubserver.JupyterHubServer
-	logger   log.Logger
+	// Set while the accept loop runs, while the server drains and once
+	// it is closed.
+	accepting int32
+	draining  int32
+	closed    int32
+
+	addr            string
+	host_key        ssh.Signer
+	listener        net.Listener
+	jhserver        *jupyterhubserver.JupyterHubServer
+	requestPolicy   *GlobalRequestPolicy
+	recorder        *recorder.Recorder
+	auditor         *audit.Auditor
+	auditKeystrokes bool
+	shadow          ShadowConfig
+	execPolicy      *ExecPolicy
+	lockout         *lockout
+	traffic         *trafficAccounting
+	sessions        *sessionRegistry
+	httpServer      *http.Server
+	adminServer     *http.Server
+	tracer          *tracing.Tracer
+	activity        *activityReporter
+	logLevels       *loglevel.Logger
+	logger          log.Logger
 }
 
-func NewSshProxyServer(addr string, host_key ssh.Signer, jhserver *jupyterhubserver.JupyterHubServer, logger log.Logger) *SshProxyServer {
-	return &SshProxyServer{addr: addr, host_key: host_key, jhserver: jhserver, logger: logger}
+func NewSshProxyServer(c SshProxyServerConfig, addr string, host_key ssh.Signer, jhserver *jupyterhubserver.JupyterHubServer, logger log.Logger) (*SshProxyServer, error) {
+	requestPolicy, err := NewGlobalRequestPolicy(c.GlobalRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := host_key
+	if c.SigningKeyPath != "" {
+		if signer, err = loadSigningKey(c.SigningKeyPath); err != nil {
+			return nil, err
+		}
+	}
+
+	recorder, err := recorder.NewRecorder(c.Recording, signer, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	execPolicy, err := NewExecPolicy(c.ExecPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	auditor, err := audit.NewAuditor(c.Audit, signer, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SshProxyServer{addr: addr,
+		host_key:        host_key,
+		jhserver:        jhserver,
+		requestPolicy:   requestPolicy,
+		recorder:        recorder,
+		auditor:         auditor,
+		auditKeystrokes: c.AuditKeystrokes,
+		shadow:          c.Shadow,
+		execPolicy:      execPolicy,
+		lockout:         newLockout(c.Lockout),
+		traffic:         newTrafficAccounting(c.Traffic, auditor, logger),
+		sessions:        newSessionRegistry(),
+		tracer:          tracing.NewTracer(c.Tracing, logger),
+		logger:          logger}
+	s.activity = newActivityReporter(c.Activity, s.sessions, jhserver, logger)
+	s.httpServer = s.newHTTPServer(c.HTTP)
+	if c.AdminSocket != "" {
+		s.adminServer = &http.Server{Addr: c.AdminSocket, Handler: s.adminHandler("admin socket")}
+	}
+	return s, nil
+}
+
+// SetLogLevels lets the admin API change the log levels, logger must be
+// the logger of the server or wrap it.
+func (s *SshProxyServer) SetLogLevels(logger *loglevel.Logger) {
+	s.logLevels = logger
 }
 
 func (s *SshProxyServer) ListenAndServe() error {
@@ -33,112 +114,516 @@ func (s *SshProxyServer) ListenAndServe() error {
 	}
 	s.listener = listener
 
-	defer s.Close()
-
-	var singleusers map[string]*jupyterhubserver.SingleUser = make(map[string]*jupyterhubserver.SingleUser)
+	atomic.StoreInt32(&s.accepting, 1)
+	defer atomic.StoreInt32(&s.accepting, 0)
 
 	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&s.closed) == 1 {
+				return nil
+			}
+			s.logger.Error(MODULERNAME, fmt.Sprintf("listen.Accept failed: %v", err))
+			return err
+		}
+
+		// Per connection state, singleuser is filled in by the banner
+		// callback which runs before the first authentication attempt. The
+		// hub is asked for the servers of the user only once they are
+		// needed, for the keys of a public key login or after the login.
+		var singleuser *jupyterhubserver.SingleUser
+		var username, serverName, shadowID string
+		var serversLoaded, keysLoaded bool
+		var traffic *userTraffic
+		sess := newSession(conn.RemoteAddr().String())
+		sess.conn = conn
+		sess.span = s.tracer.Start("ssh login")
+		sess.span.SetAttribute("session.id", sess.id)
+		sess.span.SetAttribute("client.address", sess.remoteAddr)
+		sess.logger = newSessionLogger(sess, s.logger)
+		jh := s.hub(sess)
+		loadServers := func() {
+			if serversLoaded {
+				return
+			}
+			serversLoaded = true
+			singleuser = jupyterhubserver.NewSingleUser(username, "", nil, serverName, jh.GetUserServers(username))
+		}
+		s.sessions.add(sess)
+		connectionsActive.Inc()
+		s.auditor.Emit(sess.event(audit.EventConnect))
 
 		serverConf := &ssh.ServerConfig{
 			PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 				// s.logger.Info(MODULERNAME, fmt.Sprintf("Login attempt: %s, user %s password: %s", c.RemoteAddr(), c.User(), string(pass)))
-				s.logger.Info(MODULERNAME, fmt.Sprintf("Login attempt: %s, user %s", c.RemoteAddr(), c.User()))
-				clientConfig := s.jhserver.GenConnConfig()
-
-				if !s.jhserver.CheckUser(c.User(), string(pass)) {
-					s.logger.Warn(MODULERNAME, "CheckUser return false.")
-					return nil, fmt.Errorf("permission denied")
+				sess.logger.Info(MODULERNAME, fmt.Sprintf("Login attempt: %s, user %s", c.RemoteAddr(), c.User()))
+				s.auditAuthAttempt(sess, "password", "")
+				if err := s.checkLockout(sess, singleuser, "password", ""); err != nil {
+					return nil, err
 				}
 
-				server := singleusers[c.User()].GetPodIP()
-
-				if server == "" {
-					s.logger.Error(MODULERNAME, "Did not find User Pod")
-					return nil, fmt.Errorf("server not exist")
+				if !jh.CheckUser(singleuser.GetUsername(), string(pass)) {
+					sess.logger.Warn(MODULERNAME, "CheckUser return false.")
+					err := fmt.Errorf("permission denied")
+					s.auditAuthResult(sess, "password", "", err)
+					if s.lockout.fail(singleuser.GetUsername()) {
+						s.auditLockout(sess)
+					}
+					return nil, err
 				}
-				server = fmt.Sprintf("%s:%s", server, s.jhserver.GetSshPort())
-				s.logger.Info(MODULERNAME, fmt.Sprintf("user: %s prepare connection to %s", c.User(), server))
-				client, err := ssh.Dial("tcp", server, clientConfig)
 
-				singleusers[c.User()].UpdateClient(client)
-				return nil, err
+				s.lockout.succeed(singleuser.GetUsername())
+				s.auditAuthResult(sess, "password", "", nil)
+				return nil, nil
 			},
 			PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-				if !singleusers[c.User()].CheckAuthorizedKey(string(key.Marshal())) {
-					s.logger.Info(MODULERNAME, fmt.Sprintf("user: %s public key check failed", c.User()))
-					return nil, fmt.Errorf("unknown public key for %q", c.User())
+				fingerprint := ssh.FingerprintSHA256(key)
+				s.auditAuthAttempt(sess, "publickey", fingerprint)
+				if err := s.checkLockout(sess, singleuser, "publickey", fingerprint); err != nil {
+					return nil, err
 				}
-				// TODO: Is there a way to directly use remote server authorized_keys?
-				clientConfig := s.jhserver.GenConnConfig()
-
-				server := singleusers[c.User()].GetPodIP()
 
-				if server == "" {
-					s.logger.Error(MODULERNAME, "Did not find User Pod")
-					return nil, fmt.Errorf("server not exist")
+				loadServers()
+				if !keysLoaded {
+					keysLoaded = true
+					singleuser.UpdateAuthorizedKeys(s.authorizedKeys(sess, singleuser))
 				}
+				if !singleuser.CheckAuthorizedKey(string(key.Marshal())) {
+					sess.logger.Info(MODULERNAME, fmt.Sprintf("user: %s public key check failed", c.User()))
+					err := fmt.Errorf("unknown public key for %q", c.User())
+					s.auditAuthResult(sess, "publickey", fingerprint, err)
+					return nil, err
+				}
+				// TODO: Is there a way to directly use remote server authorized_keys?
 
-				server = fmt.Sprintf("%s:%s", server, s.jhserver.GetSshPort())
-				s.logger.Info(MODULERNAME, fmt.Sprintf("user: %s prepare connection to %s", c.User(), server))
-				client, err := ssh.Dial("tcp", server, clientConfig)
-
-				singleusers[c.User()].UpdateClient(client)
-				return nil, err
+				// The callback also answers unsigned queries, whether the key
+				// would do, so the login is only recorded by loginFn once the
+				// client proved it holds the key.
+				return &ssh.Permissions{Extensions: map[string]string{fingerprintExtension: fingerprint}}, nil
 			},
+			// The banner is shown before authentication, it must not tell
+			// anything about the user.
 			BannerCallback: func(c ssh.ConnMetadata) string {
-				podIP := s.jhserver.GetPodIP(c.User())
-				// TODO: error handling
-				authorizedKeysMap, _ := s.jhserver.GetUserAuthorizedKeys(podIP)
-				singleusers[c.User()] = jupyterhubserver.NewSingleUser(c.User(), "", authorizedKeysMap, podIP, &ssh.Client{})
-
-				message := "Welcome to JupyterHub SSH Client! \nNow Check Pod status... \n"
-				if podIP == "" {
-					message += "Did not find pod, please make sure user enviroment is running! \n"
-				} else {
-					message += fmt.Sprintf("Pod %s is running, use token to login, have fun! \n", singleusers[c.User()].GetPodName())
+				username, serverName = splitUser(c.User())
+				if strings.HasPrefix(serverName, ShadowPrefix) {
+					shadowID = strings.TrimPrefix(serverName, ShadowPrefix)
+					serverName = ""
 				}
+				sess.setUser(username)
+				sess.span.SetAttribute("user.name", username)
+				singleuser = jupyterhubserver.NewSingleUser(username, "", nil, serverName, nil)
 
-				return message
+				// Users quote the session ID in support requests, it is in
+				// every log line and audit event of the connection.
+				return fmt.Sprintf("Welcome to JupyterHub SSH Client! \nSession ID: %s \n", sess.id)
 			},
 		}
 
 		serverConf.AddHostKey(s.host_key)
 
-		conn, err := listener.Accept()
-		if err != nil {
-			s.logger.Error(MODULERNAME, fmt.Sprintf("listen.Accept failed: %v", err))
-			return err
-		}
-
 		sshconnprxy := &SshConnProxy{Conn: conn,
-			callbackFn: func(c ssh.ConnMetadata) (*ssh.Client, error) {
+			loginFn: func(c ssh.ConnMetadata, perms *ssh.Permissions) {
+				if perms != nil && perms.Extensions[fingerprintExtension] != "" {
+					s.lockout.succeed(username)
+					s.auditAuthResult(sess, "publickey", perms.Extensions[fingerprintExtension], nil)
+				}
+				loadServers()
+				singleuser.UpdateGroups(jh.GetUserGroups(username))
+				traffic = s.traffic.user(username)
+				sess.accountTo(traffic)
+			},
+			greetFn: func(c ssh.ConnMetadata) string {
+				if singleuser.GetPodName() == "" {
+					return ""
+				}
+				return fmt.Sprintf("Pod %s is running, have fun!", singleuser.GetPodName())
+			},
+			callbackFn: func(c ssh.ConnMetadata) (*ssh.Client, <-chan *ssh.Request, error) {
+				sess.logger.Info(MODULERNAME, fmt.Sprintf("Connection accepted from: %s", c.RemoteAddr()))
 
-				client := singleusers[c.User()].GetClient()
-				s.logger.Info(MODULERNAME, fmt.Sprintf("Connection accepted from: %s", c.RemoteAddr()))
+				if singleuser.NeedsSelection() {
+					return nil, nil, nil
+				}
 
-				return client, err
+				return s.dialUpstream(sess, singleuser)
 			},
-			wrapFn: func(c ssh.ConnMetadata, r io.ReadCloser) (io.ReadCloser, error) {
-				return NewTypeWriterReadCloser(r), nil
+			selectFn: func(c ssh.ConnMetadata, term io.ReadWriter) (*ssh.Client, <-chan *ssh.Request, error) {
+				if err := s.selectServer(sess, singleuser, term); err != nil {
+					sess.span.End(err)
+					return nil, nil, err
+				}
+
+				return s.dialUpstream(sess, singleuser)
+			},
+			recordFn: func(c ssh.ConnMetadata) *recorder.Cast {
+				if !s.recorder.ShouldRecord(singleuser.GetUsername(), singleuser.GetGroups()) {
+					return nil
+				}
+
+				cast, err := s.recorder.Open(singleuser.GetUsername(), singleuser.GetServerName(), fmt.Sprintf("%s@%s", singleuser.GetUsername(), singleuser.GetPodName()))
+				if err != nil {
+					sess.logger.Error(MODULERNAME, fmt.Sprintf("Could not start recording: %s", err.Error()))
+					return nil
+				}
+				return cast
+			},
+			jumpFn: func(c ssh.ConnMetadata, host string, port uint32) string {
+				if port != 22 && fmt.Sprint(port) != s.jhserver.GetSshPort() {
+					return ""
+				}
+
+				server, ok := jh.ResolveServer(singleuser.GetUsername(), host)
+				if !ok {
+					return ""
+				}
+				podIP := server.PodIP
+				sess.setUpstream(server.Name, server.PodName, podIP)
+
+				sess.logger.Info(MODULERNAME, fmt.Sprintf("user: %s jump to %s (%s)", c.User(), host, podIP))
+				return fmt.Sprintf("%s:%s", podIP, s.jhserver.GetSshPort())
 			},
 			closeFn: func(c ssh.ConnMetadata) error {
-				s.logger.Info(MODULERNAME, "Connection closed.")
+				sess.logger.Info(MODULERNAME, "Connection closed.")
 				return nil
 			},
-			logger: s.logger}
+			shadowFn: func(c ssh.ConnMetadata) (*session, error) {
+				if shadowID == "" {
+					return nil, nil
+				}
+				target, err := s.shadowTarget(sess, singleuser, shadowID)
+				sess.span.End(err)
+				return target, err
+			},
+			shadowNotify:  s.shadow.Notify,
+			requestPolicy: s.requestPolicy,
+			session:       sess,
+			auditor:       s.auditor,
+			logger:        sess.logger}
+
+		if s.shadow.Enabled {
+			sshconnprxy.wrapFn = func(c ssh.ConnMetadata, r io.ReadCloser) (io.ReadCloser, error) {
+				return NewTapReadCloser(r, sess.mirror.Write), nil
+			}
+		}
+
+		if s.execPolicy.Enabled() {
+			sshconnprxy.checkFn = func(c ssh.ConnMetadata, reqType string, value string) error {
+				return s.execPolicy.Check(singleuser.GetUsername(), singleuser.GetGroups(), reqType, value)
+			}
+		}
+
+		if s.auditKeystrokes {
+			sshconnprxy.keystrokeFn = func(c ssh.ConnMetadata, channelID int, line string, redacted bool) {
+				e := sess.event(audit.EventInput)
+				e.ChannelID = channelID
+				e.Input = line
+				e.Redacted = redacted
+				s.auditor.Emit(e)
+			}
+		}
 
 		go func() {
-			if err := sshconnprxy.proxy(serverConf); err != nil {
-				s.logger.Error(MODULERNAME, fmt.Sprintf("Error occured while serving %s\n", err))
+			err := sshconnprxy.proxy(serverConf)
+			// Ends the login span of a connection that never got upstream.
+			if err != nil {
+				sess.span.End(err)
+			} else {
+				sess.span.End(fmt.Errorf("connection closed during login"))
+			}
+			s.sessions.remove(sess)
+			connectionsActive.Dec()
+			if traffic != nil {
+				s.traffic.release(traffic)
+			}
+
+			e := sess.end()
+			if reason := sess.killReason(); reason != "" {
+				e.Reason = "killed: " + reason
+			} else if err != nil {
+				e.Reason = err.Error()
+			}
+			s.auditor.Emit(e)
+
+			if err != nil {
+				sess.logger.Error(MODULERNAME, fmt.Sprintf("Error occured while serving %s\n", err))
 				return
 			}
 
-			s.logger.Info(MODULERNAME, "Connection closed.")
+			sess.logger.Info(MODULERNAME, "Connection closed.")
 		}()
 	}
 
 }
 
+// hub returns the hub client of a connection, its requests are traced
+// below the login span and logged with the session.
+func (s *SshProxyServer) hub(sess *session) *jupyterhubserver.JupyterHubServer {
+	return s.jhserver.WithSpan(sess.span).WithLogger(sess.logger)
+}
+
+// splitUser splits the ssh login name "<hub user>[:<server name>]".
+func splitUser(user string) (string, string) {
+	parts := strings.SplitN(user, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// authorizedKeys collects the authorized keys of the selected pod, or of all
+// running pods when the user still has to choose one.
+func (s *SshProxyServer) authorizedKeys(sess *session, singleuser *jupyterhubserver.SingleUser) map[string]bool {
+	jh := s.hub(sess)
+
+	if !singleuser.NeedsSelection() {
+		if singleuser.GetPodIP() == "" {
+			return make(map[string]bool)
+		}
+		// TODO: error handling
+		authorizedKeysMap, _ := jh.GetUserAuthorizedKeys(singleuser.GetPodIP())
+		return authorizedKeysMap
+	}
+
+	authorizedKeysMap := make(map[string]bool)
+	for _, server := range singleuser.GetServers() {
+		if !server.Running() {
+			continue
+		}
+		keys, _ := jh.GetUserAuthorizedKeys(server.PodIP)
+		for key := range keys {
+			authorizedKeysMap[key] = true
+		}
+	}
+	return authorizedKeysMap
+}
+
+// selectServer lets the user choose a server on term, or selects the default
+// server when term is nil, and starts it when it is not running.
+func (s *SshProxyServer) selectServer(sess *session, singleuser *jupyterhubserver.SingleUser, term io.ReadWriter) error {
+	jh := s.hub(sess)
+	username := singleuser.GetUsername()
+
+	if term == nil {
+		if !singleuser.SelectServer("") {
+			return fmt.Errorf("%s has no default server", username)
+		}
+		if singleuser.GetPodIP() == "" {
+			return fmt.Errorf("default server of %s is not running", username)
+		}
+		return nil
+	}
+
+	server, err := serverMenu(term, singleuser.GetServers())
+	if err != nil {
+		return err
+	}
+	singleuser.SelectServer(server.Name)
+	sess.logger.Info(MODULERNAME, fmt.Sprintf("user: %s selected server %q", username, server.Name))
+
+	if server.Running() {
+		return nil
+	}
+
+	if serverStatus(server) == "stopped" {
+		fmt.Fprintf(term, "Starting server %s", serverLabel(server))
+		if err := jh.StartServer(username, server.Name); err != nil {
+			fmt.Fprintf(term, "\r\n")
+			return err
+		}
+	} else {
+		fmt.Fprintf(term, "Waiting for server %s", serverLabel(server))
+	}
+
+	server, err = jh.WaitServerRunning(username, server.Name, 5*time.Minute, func() {
+		fmt.Fprintf(term, ".")
+	})
+	fmt.Fprintf(term, "\r\n")
+	if err != nil {
+		return err
+	}
+
+	singleuser.UpdateServer(server)
+	return nil
+}
+
+// shadowTarget finds the session a user asked to watch, when the user may
+// watch sessions.
+func (s *SshProxyServer) shadowTarget(sess *session, singleuser *jupyterhubserver.SingleUser, id string) (*session, error) {
+	var err error
+	target := s.sessions.get(id)
+	switch {
+	case !s.shadow.Enabled:
+		err = fmt.Errorf("shadowing sessions is disabled")
+	case !s.mayShadow(sess, singleuser):
+		err = fmt.Errorf("%s may not watch sessions", singleuser.GetUsername())
+	case target == nil || target == sess:
+		err = fmt.Errorf("no session %s", id)
+	}
+
+	if err != nil {
+		sess.logger.Warn(MODULERNAME, fmt.Sprintf("user: %s shadow of session %s refused: %s", singleuser.GetUsername(), id, err.Error()))
+		e := sess.event(audit.EventShadowAttach)
+		e.Target = id
+		e.Success = audit.Bool(false)
+		e.Reason = err.Error()
+		s.auditor.Emit(e)
+		return nil, err
+	}
+
+	return target, nil
+}
+
+func (s *SshProxyServer) mayShadow(sess *session, singleuser *jupyterhubserver.SingleUser) bool {
+	username := singleuser.GetUsername()
+	for _, user := range s.shadow.Users {
+		if user == username {
+			return true
+		}
+	}
+	for _, group := range singleuser.GetGroups() {
+		for _, allowed := range s.shadow.Groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+
+	return s.shadow.HubAdmins && s.hub(sess).IsAdmin(username)
+}
+
+// fingerprintExtension carries the fingerprint of the key a public key
+// login was accepted with from the callback to the login.
+const fingerprintExtension = "pubkey-fp"
+
+// checkLockout refuses any login of a user who is blocked or locked out.
+func (s *SshProxyServer) checkLockout(sess *session, singleuser *jupyterhubserver.SingleUser, method string, fingerprint string) error {
+	var err error
+	switch {
+	case s.lockout.isBlocked(singleuser.GetUsername()):
+		err = fmt.Errorf("%s is blocked by an admin", singleuser.GetUsername())
+	case s.lockout.isLocked(singleuser.GetUsername()):
+		err = fmt.Errorf("%s is locked out after too many failed logins", singleuser.GetUsername())
+	default:
+		return nil
+	}
+
+	s.auditAuthResult(sess, method, fingerprint, err)
+	return err
+}
+
+func (s *SshProxyServer) auditLockout(sess *session) {
+	sess.logger.Warn(MODULERNAME, fmt.Sprintf("user: %s locked out for %s after %d failed logins", sess.getUser(), s.lockout.duration, s.lockout.maxFailures))
+	lockouts.Inc()
+
+	e := sess.event(audit.EventLockout)
+	e.Reason = fmt.Sprintf("%d failed logins within %s", s.lockout.maxFailures, s.lockout.window)
+	e.Duration = s.lockout.duration.Seconds()
+	s.auditor.Emit(e)
+}
+
+func (s *SshProxyServer) auditAuthAttempt(sess *session, method string, fingerprint string) {
+	e := sess.event(audit.EventAuthAttempt)
+	e.Method = method
+	e.Fingerprint = fingerprint
+	s.auditor.Emit(e)
+}
+
+// auditAuthResult records the outcome of an authentication attempt, err is
+// nil when it succeeded.
+func (s *SshProxyServer) auditAuthResult(sess *session, method string, fingerprint string, err error) {
+	authAttempts.With(method, authResult(err)).Inc()
+	if err == nil {
+		sess.setMethod(method)
+		sess.span.SetAttribute("ssh.auth.method", method)
+	}
+
+	e := sess.event(audit.EventAuthResult)
+	e.Method = method
+	e.Fingerprint = fingerprint
+	e.Success = audit.Bool(err == nil)
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	s.auditor.Emit(e)
+}
+
+// dialUpstream connects to the sshd of the selected pod.
+func (s *SshProxyServer) dialUpstream(sess *session, singleuser *jupyterhubserver.SingleUser) (*ssh.Client, <-chan *ssh.Request, error) {
+	server := singleuser.GetPodIP()
+
+	e := sess.event(audit.EventUpstream)
+	e.Server = singleuser.GetServerName()
+	e.Pod = singleuser.GetPodName()
+	e.PodIP = server
+
+	if server == "" {
+		sess.logger.Error(MODULERNAME, "Did not find User Pod")
+		e.Success = audit.Bool(false)
+		e.Reason = "server not exist"
+		s.auditor.Emit(e)
+		sess.span.End(fmt.Errorf("server not exist"))
+		// The client shows it when its first channel is refused.
+		return nil, nil, fmt.Errorf("did not find pod, please make sure user environment is running")
+	}
+
+	server = fmt.Sprintf("%s:%s", server, s.jhserver.GetSshPort())
+	sess.logger.Info(MODULERNAME, fmt.Sprintf("user: %s prepare connection to %s", singleuser.GetUsername(), server))
+	span := sess.span.Child("ssh.Dial", tracing.KindClient)
+	span.SetAttribute("server.address", server)
+	span.SetAttribute("hub.server", e.Server)
+	start := time.Now()
+	client, reqs, err := dialUpstream(server, s.jhserver.GenConnConfig())
+	upstreamDialSeconds.With("ssh").Observe(time.Since(start).Seconds())
+	span.End(err)
+	sess.span.End(err)
+	if err != nil {
+		upstreamDialFailures.With("ssh").Inc()
+	}
+	e.Success = audit.Bool(err == nil)
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	s.auditor.Emit(e)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sess.setUpstream(e.Server, e.Pod, e.PodIP)
+	singleuser.UpdateClient(client, reqs)
+	return client, reqs, nil
+}
+
+// Close stops the listeners and signs the final state of the audit log,
+// it must be called once.
 func (s *SshProxyServer) Close() error {
-	return s.listener.Close()
+	atomic.StoreInt32(&s.closed, 1)
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+	if aerr := s.auditor.Close(); aerr != nil {
+		s.logger.Error(MODULERNAME, fmt.Sprintf("Close audit log get err: %s", aerr.Error()))
+	}
+	s.activity.Close()
+	s.tracer.Close()
+	return err
+}
+
+func loadSigningKey(path string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("signing key %s: %s", path, err)
+	}
+	return signer, nil
 }
@@ -0,0 +1,20 @@
+package sshproxy
+
+// ptyRequest is the payload of a pty-req, RFC 4254 section 6.2.
+type ptyRequest struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+// windowChangeRequest is the payload of a window-change, RFC 4254
+// section 6.7.
+type windowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
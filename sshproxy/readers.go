@@ -1,50 +1,33 @@
 package sshproxy
 
 import (
-	"bytes"
-	"fmt"
 	"io"
 	"log"
-	"strings"
-	"time"
 )
 
-func NewTypeWriterReadCloser(r io.ReadCloser) io.ReadCloser {
-	return &TypeWriterReadCloser{ReadCloser: r, time: time.Now()}
+// NewTapReadCloser calls fn with every chunk read from r, e.g. to record a
+// session stream.
+func NewTapReadCloser(r io.ReadCloser, fn func(p []byte)) io.ReadCloser {
+	return &TapReadCloser{ReadCloser: r, fn: fn}
 }
 
-type TypeWriterReadCloser struct {
+type TapReadCloser struct {
 	io.ReadCloser
 
-	time   time.Time
-	buffer bytes.Buffer
+	fn func(p []byte)
 }
 
-func sanitize(s string) string {
-	s = strings.Replace(s, "\r", "", -1)
-	s = strings.Replace(s, "\n", "<br/>", -1)
-	s = strings.Replace(s, "'", "\\'", -1)
-	s = strings.Replace(s, "\b", "<backspace>", -1)
-	return s
-}
-
-func (lr *TypeWriterReadCloser) Read(p []byte) (n int, err error) {
-	n, err = lr.ReadCloser.Read(p)
-
-	now := time.Now()
-	lr.buffer.WriteString(fmt.Sprintf(".wait(%d)", int(now.Sub(lr.time).Seconds()*1000)))
-	lr.buffer.WriteString(fmt.Sprintf(".put('%s')", sanitize(string(p[:n]))))
-	lr.time = now
+func (tr *TapReadCloser) Read(p []byte) (n int, err error) {
+	n, err = tr.ReadCloser.Read(p)
+	if n > 0 {
+		tr.fn(p[:n])
+	}
 
 	return n, err
 }
 
-func (lr *TypeWriterReadCloser) String() string {
-	return lr.buffer.String()
-}
-
-func (lr *TypeWriterReadCloser) Close() error {
-	return lr.ReadCloser.Close()
+func (tr *TapReadCloser) Close() error {
+	return tr.ReadCloser.Close()
 }
 
 func NewLogReadCloser(r io.ReadCloser) io.ReadCloser {
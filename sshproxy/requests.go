@@ -0,0 +1,139 @@
+package sshproxy
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DirectionClient   = "client"
+	DirectionUpstream = "upstream"
+)
+
+const (
+	// PolicyForward sends the request to the other side and relays its reply.
+	PolicyForward = "forward"
+	// PolicyReply answers the request locally with success.
+	PolicyReply = "reply"
+	// PolicyReject answers the request locally with failure.
+	PolicyReject = "reject"
+)
+
+const keepaliveRequest = "keepalive@openssh.com"
+
+var defaultGlobalRequestRules = []GlobalRequestRule{
+	// ServerAliveInterval probes are answered by the pod, so they fail when
+	// the pod is gone.
+	{Type: keepaliveRequest, Direction: DirectionClient, Policy: PolicyForward},
+	{Type: "no-more-sessions@openssh.com", Direction: DirectionClient, Policy: PolicyForward},
+	{Type: "tcpip-forward", Direction: DirectionClient, Policy: PolicyForward},
+	{Type: "cancel-tcpip-forward", Direction: DirectionClient, Policy: PolicyForward},
+	{Type: keepaliveRequest, Direction: DirectionUpstream, Policy: PolicyForward},
+	// The pod host keys are not the keys the client connected to.
+	{Type: "hostkeys-00@openssh.com", Direction: DirectionUpstream, Policy: PolicyReject},
+	{Type: "*", Policy: PolicyReject},
+}
+
+// GlobalRequestPolicy decides what to do with connection-level requests.
+type GlobalRequestPolicy struct {
+	rules map[string]map[string]string
+}
+
+func NewGlobalRequestPolicy(rules []GlobalRequestRule) (*GlobalRequestPolicy, error) {
+	p := &GlobalRequestPolicy{rules: map[string]map[string]string{
+		DirectionClient:   make(map[string]string),
+		DirectionUpstream: make(map[string]string),
+	}}
+
+	for _, rules := range [][]GlobalRequestRule{defaultGlobalRequestRules, rules} {
+		for _, r := range rules {
+			switch r.Policy {
+			case PolicyForward, PolicyReply, PolicyReject:
+			default:
+				return nil, fmt.Errorf("global request %q: unknown policy %q", r.Type, r.Policy)
+			}
+
+			switch r.Direction {
+			case DirectionClient, DirectionUpstream:
+				p.rules[r.Direction][r.Type] = r.Policy
+			case "":
+				p.rules[DirectionClient][r.Type] = r.Policy
+				p.rules[DirectionUpstream][r.Type] = r.Policy
+			default:
+				return nil, fmt.Errorf("global request %q: unknown direction %q", r.Type, r.Direction)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func (p *GlobalRequestPolicy) Lookup(direction string, reqType string) string {
+	if policy, ok := p.rules[direction][reqType]; ok {
+		return policy
+	}
+	if policy, ok := p.rules[direction]["*"]; ok {
+		return policy
+	}
+	return PolicyReject
+}
+
+type requestSender interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+}
+
+// relayGlobalRequests applies the policy to every request read from reqs,
+// forwarding to dst when asked to. onReply, when set, sees every request
+// with the answer it got. It returns when reqs is closed.
+func relayGlobalRequests(reqs <-chan *ssh.Request, dst requestSender, direction string, policy *GlobalRequestPolicy, onReply func(req *ssh.Request, ok bool), logger log.Logger) {
+	for req := range reqs {
+		action := policy.Lookup(direction, req.Type)
+		logger.Debug(MODULERNAME, fmt.Sprintf("Global request %s from %s: %s", req.Type, direction, action))
+
+		ok := false
+		var payload []byte
+		switch action {
+		case PolicyForward:
+			var err error
+			ok, payload, err = dst.SendRequest(req.Type, req.WantReply, req.Payload)
+			if err != nil && req.Type == keepaliveRequest {
+				// No upstream yet, e.g. while the server menu is shown. The
+				// connection is closed once the upstream is closed.
+				ok = true
+			} else if err != nil {
+				logger.Warn(MODULERNAME, fmt.Sprintf("Forward global request %s get err: %s", req.Type, err.Error()))
+			}
+		case PolicyReply:
+			ok = true
+		}
+
+		if req.WantReply {
+			req.Reply(ok, payload)
+		}
+		if onReply != nil {
+			onReply(req, ok)
+		}
+	}
+}
+
+// dialUpstream works like ssh.Dial but hands back the connection-level
+// requests sent by the server instead of rejecting them.
+func dialUpstream(addr string, config *ssh.ClientConfig) (*ssh.Client, <-chan *ssh.Request, error) {
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	noReqs := make(chan *ssh.Request)
+	close(noReqs)
+
+	return ssh.NewClient(c, chans, noReqs), reqs, nil
+}
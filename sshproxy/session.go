@@ -0,0 +1,322 @@
+package sshproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jupyterhub-ssh-proxy/audit"
+	"jupyterhub-ssh-proxy/tracing"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+	"golang.org/x/crypto/ssh"
+)
+
+// session is the state of one client connection, shared by its channels.
+type session struct {
+	// Updated atomically, kept first for 64-bit alignment.
+	bytesIn  int64
+	bytesOut int64
+	// lastActivity is when channel traffic was last relayed, in unix
+	// nanoseconds.
+	lastActivity int64
+	channels     int32
+	open         int32
+
+	id         string
+	remoteAddr string
+	start      time.Time
+	// mirror carries the terminal output of the session to shadows.
+	mirror *mirror
+	// conn is the client connection, closed to kill the session.
+	conn io.Closer
+	// logger logs with the session ID, user and remote address.
+	logger log.Logger
+	// span traces the login, from accept until the upstream connection is
+	// up or the connection ends.
+	span *tracing.Span
+
+	mu      sync.Mutex
+	user    string
+	method  string
+	server  string
+	pod     string
+	podIP   string
+	killed  string
+	traffic *userTraffic
+	// Client side of the open session channels, by channel ID.
+	terminals map[int]ssh.Channel
+}
+
+// SessionInfo describes an open connection, as the admin API lists it.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	Server     string    `json:"server,omitempty"`
+	Pod        string    `json:"pod,omitempty"`
+	PodIP      string    `json:"pod_ip,omitempty"`
+	Start      time.Time `json:"start"`
+	Channels   int       `json:"channels"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+}
+
+// newSessionID returns a short random ID, also used for the audit events
+// that do not belong to a connection.
+func newSessionID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func newSession(remoteAddr string) *session {
+	return &session{id: newSessionID(),
+		remoteAddr: remoteAddr,
+		start:      time.Now(),
+		mirror:     newMirror(),
+		terminals:  make(map[int]ssh.Channel)}
+}
+
+func (s *session) setUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+}
+
+func (s *session) getUser() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+// setMethod records the method the user logged in with.
+func (s *session) setMethod(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.method = method
+}
+
+// setUpstream records the server and pod the session is connected to.
+func (s *session) setUpstream(server string, pod string, podIP string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.server = server
+	s.pod = pod
+	s.podIP = podIP
+}
+
+// activity returns the server the session is connected to and when it
+// last relayed traffic, zero when it never did.
+func (s *session) activity() (string, string, time.Time) {
+	s.mu.Lock()
+	user, server, podIP := s.user, s.server, s.podIP
+	s.mu.Unlock()
+
+	var last time.Time
+	if n := atomic.LoadInt64(&s.lastActivity); n != 0 {
+		last = time.Unix(0, n)
+	}
+	if podIP == "" {
+		// Not connected to a pod, e.g. a shadow.
+		return user, server, time.Time{}
+	}
+	return user, server, last
+}
+
+func (s *session) info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SessionInfo{ID: s.id,
+		User:       s.user,
+		RemoteAddr: s.remoteAddr,
+		AuthMethod: s.method,
+		Server:     s.server,
+		Pod:        s.pod,
+		PodIP:      s.podIP,
+		Start:      s.start,
+		Channels:   int(atomic.LoadInt32(&s.open)),
+		BytesIn:    atomic.LoadInt64(&s.bytesIn),
+		BytesOut:   atomic.LoadInt64(&s.bytesOut)}
+}
+
+// kill tells the user why and closes the connection.
+func (s *session) kill(reason string) {
+	s.mu.Lock()
+	s.killed = reason
+	s.mu.Unlock()
+
+	// notice gives up after noticeTimeout, the connection is closed even
+	// when the client does not read.
+	s.notice("Session terminated: " + reason)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *session) killReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.killed
+}
+
+func (s *session) addTerminal(id int, channel ssh.Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.terminals[id] = channel
+}
+
+func (s *session) removeTerminal(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.terminals, id)
+}
+
+// noticeTimeout is how long notice waits for the terminals to take the
+// message, a client that stopped reading blocks the writes.
+const noticeTimeout = 2 * time.Second
+
+// notice shows a message on every terminal of the session. It returns once
+// every terminal took it, or after noticeTimeout.
+func (s *session) notice(message string) {
+	s.mu.Lock()
+	terminals := make([]ssh.Channel, 0, len(s.terminals))
+	for _, channel := range s.terminals {
+		terminals = append(terminals, channel)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{}, len(terminals))
+	for _, channel := range terminals {
+		go func(channel ssh.Channel) {
+			channel.Stderr().Write([]byte("\r\n*** " + message + " ***\r\n"))
+			done <- struct{}{}
+		}(channel)
+	}
+
+	timeout := time.NewTimer(noticeTimeout)
+	defer timeout.Stop()
+	for range terminals {
+		select {
+		case <-done:
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// accountTo adds the traffic of the session to the daily traffic of its user.
+func (s *session) accountTo(traffic *userTraffic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traffic = traffic
+}
+
+// nextChannelID numbers the channels of the session from 1.
+func (s *session) nextChannelID() int {
+	return int(atomic.AddInt32(&s.channels, 1))
+}
+
+// openChannel and closeChannel count the channels open.
+func (s *session) openChannel(channelType string) {
+	atomic.AddInt32(&s.open, 1)
+	channelsActive.With(channelType).Inc()
+}
+
+func (s *session) closeChannel(channelType string) {
+	atomic.AddInt32(&s.open, -1)
+	channelsActive.With(channelType).Dec()
+}
+
+// addBytes counts traffic as it is relayed, in is what the client sends,
+// out what it receives.
+func (s *session) addBytes(in int64, out int64) {
+	atomic.AddInt64(&s.bytesIn, in)
+	atomic.AddInt64(&s.bytesOut, out)
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	bytesRelayedIn.Add(float64(in))
+	bytesRelayedOut.Add(float64(out))
+
+	s.mu.Lock()
+	traffic := s.traffic
+	s.mu.Unlock()
+	if traffic != nil {
+		traffic.add(s.id, in, out)
+	}
+}
+
+// event starts an audit event of the session.
+func (s *session) event(eventType string) audit.Event {
+	return audit.Event{Time: time.Now(),
+		Type:       eventType,
+		SessionID:  s.id,
+		User:       s.getUser(),
+		RemoteAddr: s.remoteAddr}
+}
+
+// end is the closing event of the session with its totals.
+func (s *session) end() audit.Event {
+	e := s.event(audit.EventSessionEnd)
+	e.BytesIn = atomic.LoadInt64(&s.bytesIn)
+	e.BytesOut = atomic.LoadInt64(&s.bytesOut)
+	e.Duration = time.Since(s.start).Seconds()
+	return e
+}
+
+// sessionRegistry keeps the sessions of all open connections.
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.id] = s
+}
+
+// remove drops a closed session and detaches its shadows.
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	delete(r.sessions, s.id)
+	r.mu.Unlock()
+
+	s.mirror.close()
+}
+
+func (r *sessionRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+func (r *sessionRegistry) get(id string) *session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sessions[id]
+}
+
+// list returns the sessions in the order they started.
+func (r *sessionRegistry) list() []*session {
+	r.mu.RLock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].start.Before(sessions[j].start)
+	})
+	return sessions
+}
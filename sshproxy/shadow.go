@@ -0,0 +1,209 @@
+package sshproxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"jupyterhub-ssh-proxy/audit"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ShadowPrefix starts the server part of a login name that watches another
+// session, e.g. "admin:shadow:1f2e3d4c".
+const ShadowPrefix = "shadow:"
+
+// mirrorBuffer is how many chunks of output a shadow may lag behind before
+// chunks are dropped for it.
+const mirrorBuffer = 256
+
+// mirror copies the terminal output of a session to the shadows watching
+// it. A shadow that cannot keep up misses output, it never slows down the
+// session it watches.
+type mirror struct {
+	mu       sync.Mutex
+	watchers map[chan []byte]bool
+	closed   bool
+}
+
+func newMirror() *mirror {
+	return &mirror{watchers: make(map[chan []byte]bool)}
+}
+
+func (m *mirror) Write(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.watchers) == 0 {
+		return
+	}
+
+	chunk := append([]byte(nil), p...)
+	for watcher := range m.watchers {
+		select {
+		case watcher <- chunk:
+		default:
+		}
+	}
+}
+
+// watch returns a channel of the output, closed when the session ends, or
+// nil when it has already ended.
+func (m *mirror) watch() chan []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	watcher := make(chan []byte, mirrorBuffer)
+	m.watchers[watcher] = true
+	return watcher
+}
+
+func (m *mirror) unwatch(watcher chan []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.watchers[watcher] {
+		delete(m.watchers, watcher)
+		close(watcher)
+	}
+}
+
+func (m *mirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	for watcher := range m.watchers {
+		delete(m.watchers, watcher)
+		close(watcher)
+	}
+}
+
+// shadow serves a connection that watches another session. Only session
+// channels are accepted, and what is typed is never sent anywhere. When
+// shadowErr is set the shadow was refused and the error is shown instead.
+func (p *SshConnProxy) shadow(chans <-chan ssh.NewChannel, target *session, shadowErr error) {
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.Prohibited, "shadow sessions are read-only")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			p.logger.Error(MODULERNAME, fmt.Sprintf("Could not accept shadow channel: %s", err.Error()))
+			continue
+		}
+
+		go p.watch(channel, requests, target, shadowErr)
+	}
+}
+
+func (p *SshConnProxy) watch(channel ssh.Channel, requests <-chan *ssh.Request, target *session, shadowErr error) {
+	defer channel.Close()
+
+	shell := false
+	for req := range requests {
+		switch req.Type {
+		case "pty-req", "env", "window-change":
+			req.Reply(true, nil)
+			continue
+		case "shell":
+			shell = true
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+			continue
+		}
+		break
+	}
+	if !shell {
+		return
+	}
+
+	go func() {
+		for req := range requests {
+			if req.WantReply {
+				req.Reply(req.Type == "window-change", nil)
+			}
+		}
+	}()
+
+	if shadowErr != nil {
+		fmt.Fprintf(channel.Stderr(), "%s\r\n", shadowErr.Error())
+		sendExitStatus(channel, 1)
+		return
+	}
+
+	output := target.mirror.watch()
+	if output == nil {
+		fmt.Fprintf(channel.Stderr(), "session %s has ended\r\n", target.id)
+		sendExitStatus(channel, 1)
+		return
+	}
+	defer target.mirror.unwatch(output)
+
+	watcher := p.session.getUser()
+	p.auditShadow(audit.EventShadowAttach, target)
+	p.logger.Info(MODULERNAME, fmt.Sprintf("user: %s attached to session %s of %s", watcher, target.id, target.getUser()))
+	// The watched client may not read, the shadow does not wait for it.
+	if p.shadowNotify {
+		go target.notice(fmt.Sprintf("%s is watching this session", watcher))
+	}
+	defer func() {
+		p.auditShadow(audit.EventShadowDetach, target)
+		p.logger.Info(MODULERNAME, fmt.Sprintf("user: %s detached from session %s of %s", watcher, target.id, target.getUser()))
+		if p.shadowNotify {
+			go target.notice(fmt.Sprintf("%s stopped watching this session", watcher))
+		}
+	}()
+
+	fmt.Fprintf(channel, "Watching session %s of %s, read-only. Press Ctrl-C or Ctrl-D to detach.\r\n", target.id, target.getUser())
+
+	// Input is only read to notice the detach keys.
+	detach := make(chan struct{})
+	go func() {
+		defer close(detach)
+		b := make([]byte, 256)
+		for {
+			n, err := channel.Read(b)
+			if err != nil || strings.ContainsAny(string(b[:n]), "\x03\x04") {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case chunk, ok := <-output:
+			if !ok {
+				fmt.Fprintf(channel, "\r\nSession %s has ended.\r\n", target.id)
+				sendExitStatus(channel, 0)
+				return
+			}
+			channel.Write(chunk)
+		case <-detach:
+			fmt.Fprintf(channel, "\r\nDetached.\r\n")
+			sendExitStatus(channel, 0)
+			return
+		}
+	}
+}
+
+func (p *SshConnProxy) auditShadow(eventType string, target *session) {
+	e := p.session.event(eventType)
+	e.Target = target.id
+	e.WatchedUser = target.getUser()
+	if eventType == audit.EventShadowAttach {
+		e.Success = audit.Bool(true)
+	}
+	p.audit(e)
+}
+
+func sendExitStatus(channel ssh.Channel, status uint32) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(exitStatusRequest{Status: status}))
+}
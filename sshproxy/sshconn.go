@@ -3,18 +3,50 @@ package sshproxy
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jupyterhub-ssh-proxy/audit"
+	"jupyterhub-ssh-proxy/recorder"
 
 	log "github.com/lylelaii/golang_utils/logger/v1"
 	"golang.org/x/crypto/ssh"
 )
 
+// refuseTimeout bounds the wait for the channel that carries the reason a
+// connection has no upstream.
+const refuseTimeout = 10 * time.Second
+
 type SshConnProxy struct {
 	net.Conn
-	callbackFn func(c ssh.ConnMetadata) (*ssh.Client, error)
-	wrapFn     func(c ssh.ConnMetadata, r io.ReadCloser) (io.ReadCloser, error)
-	closeFn    func(c ssh.ConnMetadata) error
-	logger     log.Logger
+	// loginFn runs once the client is authenticated, before anything else,
+	// perms are the ones returned by the callback that accepted the login.
+	loginFn     func(c ssh.ConnMetadata, perms *ssh.Permissions)
+	callbackFn  func(c ssh.ConnMetadata) (*ssh.Client, <-chan *ssh.Request, error)
+	wrapFn      func(c ssh.ConnMetadata, r io.ReadCloser) (io.ReadCloser, error)
+	closeFn     func(c ssh.ConnMetadata) error
+	jumpFn      func(c ssh.ConnMetadata, host string, port uint32) string
+	selectFn    func(c ssh.ConnMetadata, term io.ReadWriter) (*ssh.Client, <-chan *ssh.Request, error)
+	recordFn    func(c ssh.ConnMetadata) *recorder.Cast
+	keystrokeFn func(c ssh.ConnMetadata, channelID int, line string, redacted bool)
+	// shadowFn returns the session to watch when the connection is a
+	// shadow, or the reason it may not watch it.
+	shadowFn     func(c ssh.ConnMetadata) (*session, error)
+	shadowNotify bool
+	// greetFn returns the message shown on the first interactive shell of
+	// the connection, before the output of the pod.
+	greetFn func(c ssh.ConnMetadata) string
+	greeted int32
+	// checkFn decides on the shell, exec and subsystem requests of session
+	// channels, value is the command line or subsystem name.
+	checkFn       func(c ssh.ConnMetadata, reqType string, value string) error
+	requestPolicy *GlobalRequestPolicy
+	session       *session
+	auditor       *audit.Auditor
+	logger        log.Logger
 }
 
 func (p *SshConnProxy) proxy(serverConf *ssh.ServerConfig) error {
@@ -26,95 +58,324 @@ func (p *SshConnProxy) proxy(serverConf *ssh.ServerConfig) error {
 
 	defer serverConn.Close()
 
-	clientConn, err := p.callbackFn(serverConn)
+	if p.loginFn != nil {
+		p.loginFn(serverConn, serverConn.Permissions)
+	}
+
+	upstream := &upstreamConn{}
+	go relayGlobalRequests(reqs, upstream, DirectionClient, p.requestPolicy, p.auditGlobalRequest, p.logger)
+
+	if p.shadowFn != nil {
+		if target, err := p.shadowFn(serverConn); target != nil || err != nil {
+			p.shadow(chans, target, err)
+			if p.closeFn != nil {
+				p.closeFn(serverConn)
+			}
+			return nil
+		}
+	}
+
+	clientConn, clientReqs, err := p.callbackFn(serverConn)
 	if err != nil {
 		p.logger.Error(MODULERNAME, fmt.Sprintf("failed to %s", err.Error()))
+		refuseChannel(chans, err)
 		return (err)
 	}
 
+	// The user has several servers, the upstream is chosen with the
+	// first channel.
+	var pending *pendingChannel
+	if clientConn == nil {
+		clientConn, clientReqs, pending, err = p.pickUpstream(serverConn, chans)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			p.logger.Error(MODULERNAME, fmt.Sprintf("failed to select server: %s", err.Error()))
+			return err
+		}
+	}
+
 	defer clientConn.Close()
 
-	go ssh.DiscardRequests(reqs)
+	upstream.set(clientConn)
+	go func() {
+		// Without its upstream the connection is of no use, and keepalives
+		// must not be answered for it.
+		clientConn.Wait()
+		serverConn.Close()
+	}()
+	go relayGlobalRequests(clientReqs, serverConn, DirectionUpstream, p.requestPolicy, nil, p.logger)
+	go p.relayForwardedChannels(serverConn, clientConn.HandleChannelOpen("forwarded-tcpip"))
+
+	if pending != nil {
+		go p.startPending(serverConn, clientConn, pending)
+	}
 
 	for newChannel := range chans {
+		p.handleChannel(serverConn, clientConn, newChannel)
+	}
 
-		channel2, requests2, err2 := clientConn.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
-		if err2 != nil {
-			p.logger.Error(MODULERNAME, fmt.Sprintf("Could not accept client channel: %s", err.Error()))
+	if p.closeFn != nil {
+		p.closeFn(serverConn)
+	}
 
-			return err
-		}
+	return nil
+}
 
-		channel, requests, err := newChannel.Accept()
-		if err != nil {
-			p.logger.Error(MODULERNAME, fmt.Sprintf("Could not accept server channel: %s", err.Error()))
+// handleChannel opens the matching channel upstream, or on the pod sshd for
+// ProxyJump targets, and bridges the two.
+func (p *SshConnProxy) handleChannel(serverConn *ssh.ServerConn, clientConn *ssh.Client, newChannel ssh.NewChannel) {
+	if err := p.checkChannel(serverConn, newChannel); err != nil {
+		rejectChannel(newChannel, err)
+		return
+	}
 
-			return err
-		}
+	if addr := p.jumpTarget(serverConn, newChannel); addr != "" {
+		go p.jump(newChannel, addr)
+		return
+	}
+
+	target := channelTarget(newChannel.ChannelType(), newChannel.ExtraData())
+	channel2, requests2, err := clientConn.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		p.logger.Warn(MODULERNAME, fmt.Sprintf("Could not open upstream %s channel: %s", newChannel.ChannelType(), err.Error()))
+		p.auditRefused(newChannel.ChannelType(), target, err)
+		rejectChannel(newChannel, err)
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		p.logger.Error(MODULERNAME, fmt.Sprintf("Could not accept server channel: %s", err.Error()))
+		channel2.Close()
+		return
+	}
+
+	go p.newBridge(serverConn, newChannel.ChannelType(), target, channel, requests, channel2, requests2).run()
+}
+
+// newBridge prepares the bridge of two channels, wrapping its streams for
+// the output wrapper, the audit stream and the session recording.
+func (p *SshConnProxy) newBridge(serverConn *ssh.ServerConn, channelType string, target string, channel ssh.Channel, requests <-chan *ssh.Request, channel2 ssh.Channel, requests2 <-chan *ssh.Request) *channelBridge {
+	// connect channels
+	p.logger.Info(MODULERNAME, "Connecting channels.")
+
+	bridge := newChannelBridge(channel, requests, channel2, requests2, p.logger)
+	if p.wrapFn != nil && channelType == "session" {
+		p.wrapOutput(serverConn, bridge)
+	}
+
+	channelID := p.auditChannel(bridge, channelType, target)
+	if p.checkFn != nil && channelType == "session" {
+		bridge.check = p.checkRequest(serverConn, channelID)
+	}
+	if channelType == "session" {
+		p.session.addTerminal(channelID, channel)
+		bridge.onClose = append(bridge.onClose, func() {
+			p.session.removeTerminal(channelID)
+		})
+	}
+
+	if p.greetFn != nil && channelType == "session" {
+		p.greet(serverConn, bridge, channel)
+	}
 
-		// connect requests
-		go func() {
-			p.logger.Info(MODULERNAME, "Waiting for request")
+	if p.keystrokeFn != nil && channelType == "session" {
+		p.auditKeystrokes(serverConn, bridge, channelID)
+	}
 
-		r:
-			for {
-				var req *ssh.Request
-				var dst ssh.Channel
+	if p.recordFn != nil && channelType == "session" {
+		p.recordChannel(serverConn, bridge)
+	}
 
-				select {
-				case req = <-requests:
-					dst = channel2
-				case req = <-requests2:
-					dst = channel
-				}
+	return bridge
+}
 
-				// p.logger.Info(MODULERNAME, fmt.Sprintf("Request: %s %s %s %s\n", dst, req.Type, req.WantReply, req.Payload))
+// greet shows the message of greetFn when a shell with a terminal starts,
+// only once per connection.
+func (p *SshConnProxy) greet(serverConn *ssh.ServerConn, bridge *channelBridge, channel ssh.Channel) {
+	pty := false
+	bridge.onRequest = append(bridge.onRequest, func(req *ssh.Request) {
+		switch req.Type {
+		case "pty-req":
+			pty = true
+		case "shell":
+			if !pty || !atomic.CompareAndSwapInt32(&p.greeted, 0, 1) {
+				return
+			}
+			if message := p.greetFn(serverConn); message != "" {
+				channel.Stderr().Write([]byte(message + "\r\n"))
+			}
+		}
+	})
+}
 
-				b, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
-				if err != nil {
-					p.logger.Error(MODULERNAME, fmt.Sprintf("%s", err))
+// wrapOutput passes the output of a session, stdout and stderr, through
+// wrapFn.
+func (p *SshConnProxy) wrapOutput(serverConn *ssh.ServerConn, bridge *channelBridge) {
+	stdout, err := p.wrapFn(serverConn, bridge.stdout)
+	if err != nil {
+		p.logger.Warn(MODULERNAME, fmt.Sprintf("Could not wrap channel: %s", err.Error()))
+		return
+	}
+	stderr, err := p.wrapFn(serverConn, ioutil.NopCloser(bridge.stderr))
+	if err != nil {
+		p.logger.Warn(MODULERNAME, fmt.Sprintf("Could not wrap channel: %s", err.Error()))
+		return
+	}
 
-				}
+	bridge.stdout = stdout
+	bridge.stderr = stderr
+}
 
-				if req.WantReply {
-					req.Reply(b, nil)
-				}
+// recordChannel records everything shown on the terminal of a session, and
+// the lines typed at the terminal when the recording takes input. Lines
+// typed while the pod did not echo are recorded as RedactedInput. The
+// recording starts with the pty-req or shell request, so file transfers
+// over exec and subsystems are not recorded.
+func (p *SshConnProxy) recordChannel(serverConn *ssh.ServerConn, bridge *channelBridge) {
+	var mu sync.Mutex
+	var cast *recorder.Cast
+	current := func() *recorder.Cast {
+		mu.Lock()
+		defer mu.Unlock()
+		return cast
+	}
+
+	output := func(b []byte) {
+		if cast := current(); cast != nil {
+			cast.Output(b)
+		}
+	}
+	bridge.stdout = NewTapReadCloser(bridge.stdout, output)
+	bridge.stderr = NewTapReadCloser(ioutil.NopCloser(bridge.stderr), output)
+	p.watchKeystrokes(bridge, func(line string, redacted bool) {
+		if cast := current(); cast != nil && cast.RecordsInput() {
+			cast.Input([]byte(line + "\r"))
+		}
+	})
 
-				switch req.Type {
-				case "exit-status":
-					break r
-				case "exec":
-					// not supported (yet)
-				default:
-					p.logger.Info(MODULERNAME, req.Type)
-				}
+	started := false
+	bridge.onRequest = append(bridge.onRequest, func(req *ssh.Request) {
+		if !started && (req.Type == "pty-req" || req.Type == "shell") {
+			started = true
+			c := p.recordFn(serverConn)
+			mu.Lock()
+			cast = c
+			mu.Unlock()
+		}
+		cast := current()
+		if cast == nil {
+			return
+		}
+
+		switch req.Type {
+		case "pty-req":
+			var pty ptyRequest
+			if err := ssh.Unmarshal(req.Payload, &pty); err == nil {
+				cast.SetTerminal(pty.Term, int(pty.Columns), int(pty.Rows))
+			}
+		case "window-change":
+			var wc windowChangeRequest
+			if err := ssh.Unmarshal(req.Payload, &wc); err == nil {
+				cast.Resize(int(wc.Columns), int(wc.Rows))
 			}
+		}
+	})
+	bridge.onClose = append(bridge.onClose, func() {
+		cast := current()
+		if cast == nil {
+			return
+		}
+		if err := cast.Close(); err != nil {
+			p.logger.Warn(MODULERNAME, fmt.Sprintf("Recording incomplete: %s", err.Error()))
+		}
+	})
+}
 
-			channel.Close()
-			channel2.Close()
-		}()
+// auditKeystrokes reports the lines typed in a session to the audit stream.
+func (p *SshConnProxy) auditKeystrokes(serverConn *ssh.ServerConn, bridge *channelBridge, channelID int) {
+	p.watchKeystrokes(bridge, func(line string, redacted bool) {
+		p.keystrokeFn(serverConn, channelID, line, redacted)
+	})
+}
 
-		// connect channels
-		p.logger.Info(MODULERNAME, "Connecting channels.")
+// watchKeystrokes passes the lines typed in a session to report once it has
+// a terminal, with lines typed while the pod did not echo redacted.
+func (p *SshConnProxy) watchKeystrokes(bridge *channelBridge, report func(line string, redacted bool)) {
+	var active int32
+	auditor := newKeystrokeAuditor(report)
 
-		var wrappedChannel io.ReadCloser = channel
-		var wrappedChannel2 io.ReadCloser = channel2
+	bridge.stdin = NewTapReadCloser(bridge.stdin, func(b []byte) {
+		if atomic.LoadInt32(&active) == 1 {
+			auditor.Input(b)
+		}
+	})
+	bridge.stdout = NewTapReadCloser(bridge.stdout, func(b []byte) {
+		if atomic.LoadInt32(&active) == 1 {
+			auditor.Output(b)
+		}
+	})
+	bridge.stderr = NewTapReadCloser(ioutil.NopCloser(bridge.stderr), func(b []byte) {
+		if atomic.LoadInt32(&active) == 1 {
+			auditor.Output(b)
+		}
+	})
 
-		if p.wrapFn != nil {
-			// wrappedChannel, err = p.wrapFn(channel)
-			wrappedChannel2, _ = p.wrapFn(serverConn, channel2)
+	bridge.onRequest = append(bridge.onRequest, func(req *ssh.Request) {
+		if req.Type == "pty-req" {
+			atomic.StoreInt32(&active, 1)
 		}
+	})
+	bridge.onClose = append(bridge.onClose, auditor.Close)
+}
 
-		go io.Copy(channel2, wrappedChannel)
-		go io.Copy(channel, wrappedChannel2)
+// relayForwardedChannels opens a channel to the ssh client for every
+// forwarded-tcpip channel the user pod opens after a tcpip-forward request.
+func (p *SshConnProxy) relayForwardedChannels(serverConn ssh.Conn, chans <-chan ssh.NewChannel) {
+	for newChannel := range chans {
+		target := channelTarget(newChannel.ChannelType(), newChannel.ExtraData())
+		channel, requests, err := serverConn.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+		if err != nil {
+			p.logger.Warn(MODULERNAME, fmt.Sprintf("Could not open forwarded channel: %s", err.Error()))
+			p.auditRefused(newChannel.ChannelType(), target, err)
+			rejectChannel(newChannel, err)
+			continue
+		}
 
-		defer wrappedChannel.Close()
-		defer wrappedChannel2.Close()
+		channel2, requests2, err := newChannel.Accept()
+		if err != nil {
+			p.logger.Error(MODULERNAME, fmt.Sprintf("Could not accept forwarded channel: %s", err.Error()))
+			channel.Close()
+			continue
+		}
+
+		bridge := newChannelBridge(channel, requests, channel2, requests2, p.logger)
+		p.auditChannel(bridge, newChannel.ChannelType(), target)
+		go bridge.run()
 	}
+}
 
-	if p.closeFn != nil {
-		p.closeFn(serverConn)
+// refuseChannel rejects the first channel the client opens with the reason
+// the connection cannot be served, ssh clients show it to the user.
+func refuseChannel(chans <-chan ssh.NewChannel, err error) {
+	select {
+	case newChannel, ok := <-chans:
+		if ok {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+	case <-time.After(refuseTimeout):
 	}
+}
 
-	return nil
+// rejectChannel turns a failed channel open on the other side into a reject,
+// keeping the reason and message when the other side sent them.
+func rejectChannel(newChannel ssh.NewChannel, err error) {
+	if openErr, ok := err.(*ssh.OpenChannelError); ok {
+		newChannel.Reject(openErr.Reason, openErr.Message)
+		return
+	}
+
+	newChannel.Reject(ssh.ConnectionFailed, err.Error())
 }
@@ -0,0 +1,170 @@
+package sshproxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jupyterhub-ssh-proxy/audit"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+)
+
+type TrafficConfig struct {
+	// DailyWarnGB warns once a day about a user who relayed more than this
+	// in both directions together, 0 never warns.
+	DailyWarnGB float64 `mapstructure:"daily_warn_gb"`
+}
+
+// userTraffic is what a user relayed since the start of the day.
+type userTraffic struct {
+	// Updated atomically, kept first for 64-bit alignment.
+	bytesIn  int64
+	bytesOut int64
+	warned   int32
+
+	user  string
+	owner *trafficAccounting
+	// sessions are the open sessions of the user, guarded by the mutex of
+	// the owner.
+	sessions int
+}
+
+// add counts traffic of the session sessionID, which is blamed when it takes
+// the user over the daily warning.
+func (u *userTraffic) add(sessionID string, in int64, out int64) {
+	total := atomic.AddInt64(&u.bytesIn, in) + atomic.AddInt64(&u.bytesOut, out)
+
+	warn := u.owner.warnBytes
+	if warn > 0 && total > warn && atomic.CompareAndSwapInt32(&u.warned, 0, 1) {
+		u.owner.warn(u, sessionID, total)
+	}
+}
+
+// TrafficTotal is what a user relayed on a day.
+type TrafficTotal struct {
+	User     string
+	BytesIn  int64
+	BytesOut int64
+}
+
+// trafficAccounting keeps the running traffic of every user for the current
+// day and rolls it up into the audit stream at midnight.
+type trafficAccounting struct {
+	mu        sync.Mutex
+	users     map[string]*userTraffic
+	day       string
+	warnBytes int64
+	auditor   *audit.Auditor
+	logger    log.Logger
+}
+
+func newTrafficAccounting(c TrafficConfig, auditor *audit.Auditor, logger log.Logger) *trafficAccounting {
+	t := &trafficAccounting{users: make(map[string]*userTraffic),
+		day:       time.Now().Format("2006-01-02"),
+		warnBytes: int64(c.DailyWarnGB * 1024 * 1024 * 1024),
+		auditor:   auditor,
+		logger:    logger}
+
+	go t.rollupLoop()
+	return t
+}
+
+// user returns the counters of a user for a new session, release has to be
+// called when the session ends.
+func (t *trafficAccounting) user(username string) *userTraffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.users[username]
+	if !ok {
+		u = &userTraffic{user: username, owner: t}
+		t.users[username] = u
+	}
+	u.sessions++
+	return u
+}
+
+// release ends a session of a user, the counters are kept until the day is
+// rolled up.
+func (t *trafficAccounting) release(u *userTraffic) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u.sessions--
+}
+
+// Totals returns the running totals of the current day, by user name.
+func (t *trafficAccounting) Totals() []TrafficTotal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	totals := make([]TrafficTotal, 0, len(t.users))
+	for _, u := range t.users {
+		totals = append(totals, TrafficTotal{User: u.user,
+			BytesIn:  atomic.LoadInt64(&u.bytesIn),
+			BytesOut: atomic.LoadInt64(&u.bytesOut)})
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		return totals[i].User < totals[j].User
+	})
+	return totals
+}
+
+func (t *trafficAccounting) warn(u *userTraffic, sessionID string, total int64) {
+	t.logger.Warn(MODULERNAME, fmt.Sprintf("user: %s relayed %d bytes today", u.user, total))
+
+	e := audit.Event{Time: time.Now(),
+		Type:      audit.EventTrafficAlert,
+		SessionID: sessionID,
+		User:      u.user,
+		BytesIn:   atomic.LoadInt64(&u.bytesIn),
+		BytesOut:  atomic.LoadInt64(&u.bytesOut)}
+	t.auditor.Emit(e)
+}
+
+func (t *trafficAccounting) rollupLoop() {
+	for range time.Tick(time.Minute) {
+		t.rollup(time.Now().Format("2006-01-02"))
+	}
+}
+
+// rollup reports the totals of the day that ended and starts the next one,
+// when day is not the current day. Counters of users with open sessions are
+// reset but kept, those sessions keep adding to them, the others are
+// dropped.
+func (t *trafficAccounting) rollup(day string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if day == t.day {
+		return
+	}
+
+	// The events of one rollup share an ID.
+	rollupID := "traffic-" + t.day
+
+	for name, u := range t.users {
+		in := atomic.SwapInt64(&u.bytesIn, 0)
+		out := atomic.SwapInt64(&u.bytesOut, 0)
+		atomic.StoreInt32(&u.warned, 0)
+		if u.sessions == 0 {
+			delete(t.users, name)
+		}
+		if in == 0 && out == 0 {
+			continue
+		}
+
+		t.logger.Info(MODULERNAME, fmt.Sprintf("user: %s traffic on %s: %d bytes in, %d bytes out", name, t.day, in, out))
+		t.auditor.Emit(audit.Event{Time: time.Now(),
+			Type:      audit.EventTrafficDaily,
+			SessionID: rollupID,
+			User:      name,
+			Day:       t.day,
+			BytesIn:   in,
+			BytesOut:  out})
+	}
+
+	t.day = day
+}
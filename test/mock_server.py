@@ -48,7 +48,16 @@ def user_info(user_name):
                             'state': {'pod_name': 'jupyter-{}'.format(user_name)},
                             'url': '/user/{}/'.format(user_name),
                             'user_options': {'profile': 'ml-env'},
-                            'progress_url': '/hub/api/users/{}/server/progress'.format(user_name)}
+                            'progress_url': '/hub/api/users/{}/server/progress'.format(user_name)},
+                        'gpu': {'name': 'gpu',
+                            'last_activity': '2022-07-01T09:13:05.146000Z',
+                            'started': '2022-06-27T08:10:12.104152Z',
+                            'pending': None,
+                            'ready': True,
+                            'state': {'pod_name': 'jupyter-{}--gpu'.format(user_name)},
+                            'url': '/user/{}/gpu/'.format(user_name),
+                            'user_options': {'profile': 'gpu-env'},
+                            'progress_url': '/hub/api/users/{}/servers/gpu/progress'.format(user_name)}
             },
             'auth_state': None}
 
@@ -72,6 +81,12 @@ def proxy():
                 "data": {"user": "test",
                         "server_name": "",
                         "last_activity": "2022-07-03T09:53:55.092Z"}
+                },
+            "/user/test/gpu/": {"routespec": "/user/test/gpu/",
+                "target": "http://10.0.12.31:8888",
+                "data": {"user": "test",
+                        "server_name": "gpu",
+                        "last_activity": "2022-07-03T09:53:55.092Z"}
                 }
             }
 
@@ -0,0 +1,361 @@
+// Package tracing records spans and exports them to an OpenTelemetry
+// collector over OTLP/HTTP with JSON encoding, and propagates the trace
+// context in the W3C traceparent header.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/lylelaii/golang_utils/logger/v1"
+)
+
+const MODULENAME = "tracing"
+
+const (
+	DefaultEndpoint    = "http://127.0.0.1:4318/v1/traces"
+	DefaultServiceName = "jupyterhub-ssh-proxy"
+
+	queueSize     = 2048
+	batchSize     = 256
+	batchInterval = 5 * time.Second
+)
+
+// Span kinds of the OTLP protocol.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+type TracingConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Endpoint is the OTLP/HTTP traces url of the collector.
+	Endpoint    string `mapstructure:"endpoint"`
+	ServiceName string `mapstructure:"service_name"`
+	// Headers are added to every export request, e.g. an API key.
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// Tracer starts traces and exports their spans in batches in the
+// background. Spans are dropped when the collector cannot keep up. A nil
+// Tracer starts nil spans, which record nothing.
+type Tracer struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+	queue       chan *Span
+	done        chan struct{}
+	logger      log.Logger
+
+	// mu guards closed, no span is queued once the queue is closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewTracer returns nil when tracing is disabled.
+func NewTracer(c TracingConfig, logger log.Logger) *Tracer {
+	if !c.Enabled {
+		return nil
+	}
+
+	t := &Tracer{endpoint: c.Endpoint,
+		serviceName: c.ServiceName,
+		headers:     c.Headers,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, queueSize),
+		done:        make(chan struct{}),
+		logger:      logger}
+	if t.endpoint == "" {
+		t.endpoint = DefaultEndpoint
+	}
+	if t.serviceName == "" {
+		t.serviceName = DefaultServiceName
+	}
+
+	go t.run()
+	return t
+}
+
+// Start begins a new trace with a server span.
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{tracer: t, name: name, kind: KindServer, start: time.Now()}
+	rand.Read(span.traceID[:])
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// Close exports the spans that are still queued.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	<-t.done
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		// The tracer was closed while the span was open.
+		return
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+		t.logger.Warn(MODULENAME, fmt.Sprintf("Trace queue full, span %s dropped", span.name))
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, span.otlp())
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{attribute("service.name", t.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: DefaultServiceName}, Spans: spans}},
+	}}})
+	if err != nil {
+		t.logger.Error(MODULENAME, fmt.Sprintf("Marshal spans get err: %s", err.Error()))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.logger.Error(MODULENAME, fmt.Sprintf("Export spans get err: %s", err.Error()))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		t.logger.Warn(MODULENAME, fmt.Sprintf("Export %d spans get err: %s", len(batch), err.Error()))
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		t.logger.Warn(MODULENAME, fmt.Sprintf("Export %d spans get non 2xx response code: %v", len(batch), res.StatusCode))
+	}
+}
+
+// Span is one timed step of a trace. All methods may be called on a nil
+// Span, so code does not need to check whether tracing is enabled.
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []otlpAttribute
+	err        error
+	ended      bool
+}
+
+// Child starts a span of the same trace below s.
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+
+	span := &Span{tracer: s.tracer, traceID: s.traceID, parent: s.spanID, name: name, kind: kind, start: time.Now()}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// SetAttribute sets a string, bool, int, int64 or float64 attribute.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.attributes {
+		if s.attributes[i].Key == key {
+			s.attributes[i] = attribute(key, value)
+			return
+		}
+	}
+	s.attributes = append(s.attributes, attribute(key, value))
+}
+
+// End finishes the span, as failed when err is not nil. Only the first
+// call counts.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+
+	s.tracer.enqueue(s)
+}
+
+// Traceparent returns the W3C trace context header value of the span, or
+// an empty string for a nil span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// TraceID returns the hex trace ID, or an empty string for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attributes,
+		Status:            otlpStatus{Code: 1}}
+	if s.parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return span
+}
+
+// The OTLP/HTTP JSON encoding of an export request.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}